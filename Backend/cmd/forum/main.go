@@ -3,23 +3,140 @@ package main
 import (
 	"flag"
 	"forum/internal/app"
+	"forum/internal/chat"
 	"forum/internal/common"
+	"forum/internal/oidc"
+	"forum/internal/user"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"time"
 )
 
+// defaultBreachedPath is the list shipped next to createTables.sql, found
+// when the server runs from the Backend directory.
+const defaultBreachedPath = "./breachedPasswords.txt"
+
 var (
-	port int
-	path string
+	port     int
+	path     string
+	oidcPath string
+	grace    time.Duration
+	dmPolicy string
+
+	pwdMinLength  int
+	pwdMinClasses int
+	breachedPath  string
+
+	hashAlgorithm string
+	bcryptCost    int
+	argon2Time    uint
+	argon2Memory  uint
+	argon2Threads uint
+
+	wsQueue        int
+	wsWriteTimeout time.Duration
+	wsSlowPolicy   string
+	wsPing         time.Duration
+	wsPongWait     time.Duration
+	brokerAddr     string
 )
 
 func main() {
 	flag.IntVar(&port, "port", 8081, "Specify the app port.")
 	flag.StringVar(&path, "path", "./dataBase.db", "Specify path to database")
+	flag.StringVar(&oidcPath, "oidc", "", "Specify path to OpenID Connect providers config")
+	flag.DurationVar(&grace, "deletion-grace", user.DefaultDeletionPolicy.GracePeriod, "Specify how long deleted accounts can be restored")
+	flag.StringVar(&dmPolicy, "dm-policy", string(user.DefaultDeletionPolicy.DM), "Specify what happens to direct messages of deleted accounts: delete or anonymise")
+	flag.IntVar(&pwdMinLength, "pwd-min-length", user.DefaultPasswordPolicy.MinLength, "Specify the minimum password length")
+	flag.IntVar(&pwdMinClasses, "pwd-min-classes", user.DefaultPasswordPolicy.MinClasses, "Specify how many character classes a password must contain")
+	flag.StringVar(&breachedPath, "breached-passwords", defaultBreachedPath, "Specify path to the list of breached password hashes, empty to disable the check")
+	flag.StringVar(&hashAlgorithm, "hash", string(user.DefaultHashParams.Algorithm), "Specify the password hash algorithm: argon2id or bcrypt")
+	flag.IntVar(&bcryptCost, "bcrypt-cost", user.DefaultHashParams.BcryptCost, "Specify the bcrypt cost")
+	flag.UintVar(&argon2Time, "argon2-time", uint(user.DefaultHashParams.Argon2.Time), "Specify the number of Argon2id passes")
+	flag.UintVar(&argon2Memory, "argon2-memory", uint(user.DefaultHashParams.Argon2.Memory), "Specify the Argon2id memory in KiB")
+	flag.UintVar(&argon2Threads, "argon2-threads", uint(user.DefaultHashParams.Argon2.Threads), "Specify the Argon2id parallelism")
+	flag.IntVar(&wsQueue, "ws-queue", chat.DefaultHubOptions.QueueSize, "Specify how many outbound messages are queued per websocket")
+	flag.DurationVar(&wsWriteTimeout, "ws-write-timeout", chat.DefaultHubOptions.WriteTimeout, "Specify how long a websocket write may take")
+	flag.StringVar(&wsSlowPolicy, "ws-slow-policy", string(chat.DefaultHubOptions.Policy), "Specify what happens when a websocket queue is full: drop or disconnect")
+	flag.DurationVar(&wsPing, "ws-ping-interval", chat.DefaultHubOptions.PingInterval, "Specify how often websockets are pinged")
+	flag.DurationVar(&wsPongWait, "ws-pong-wait", chat.DefaultHubOptions.PongWait, "Specify how long a silent websocket is kept open")
+	flag.StringVar(&brokerAddr, "broker", "", "Specify the Redis address (host:port) shared by several instances, empty for a single instance")
 	flag.Parse()
 
+	var cfg app.Config
+	oidcCfg, err := oidc.LoadConfig(oidcPath)
+	if err != nil {
+		panic(err)
+	}
+	cfg.OIDC = oidcCfg
+
+	cfg.Deletion = user.DeletionPolicy{GracePeriod: grace, DM: user.DMPolicy(dmPolicy)}
+	if !cfg.Deletion.DM.IsValid() {
+		panic("unknown direct message policy: " + dmPolicy)
+	}
+
+	cfg.Password = user.DefaultPasswordPolicy
+	cfg.Password.MinLength = pwdMinLength
+	cfg.Password.MinClasses = pwdMinClasses
+	if breachedPath == defaultBreachedPath && !flagSet("breached-passwords") {
+		// a list named explicitly has to exist, the default one may not
+		if _, err := os.Stat(breachedPath); os.IsNotExist(err) {
+			common.WarningLogger.Printf("%s not found, breached passwords are not checked; set -breached-passwords", breachedPath)
+			breachedPath = ""
+		}
+	}
+	if breachedPath != "" {
+		cfg.Password.Breached, err = user.LoadBreachedList(breachedPath)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	cfg.Hash = user.DefaultHashParams
+	cfg.Hash.Algorithm = user.HashAlgorithm(hashAlgorithm)
+	if !cfg.Hash.Algorithm.IsValid() {
+		panic("unknown password hash algorithm: " + hashAlgorithm)
+	}
+	if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+		panic("bcrypt cost is out of range")
+	}
+	if argon2Time == 0 || argon2Memory == 0 || argon2Threads == 0 || argon2Threads > 255 {
+		panic("argon2 parameters are out of range")
+	}
+	cfg.Hash.BcryptCost = bcryptCost
+	cfg.Hash.Argon2.Time = uint32(argon2Time)
+	cfg.Hash.Argon2.Memory = uint32(argon2Memory)
+	cfg.Hash.Argon2.Threads = uint8(argon2Threads)
+
+	cfg.Hub = chat.DefaultHubOptions
+	cfg.Hub.QueueSize = wsQueue
+	cfg.Hub.WriteTimeout = wsWriteTimeout
+	cfg.Hub.Policy = chat.SlowConsumerPolicy(wsSlowPolicy)
+	if !cfg.Hub.Policy.IsValid() {
+		panic("unknown slow consumer policy: " + wsSlowPolicy)
+	}
+	cfg.Hub.PingInterval = wsPing
+	cfg.Hub.PongWait = wsPongWait
+	if wsPongWait <= wsPing {
+		panic("ws-pong-wait must be longer than ws-ping-interval")
+	}
+
+	cfg.Broker = brokerAddr
+
 	a := new(app.App)
-	err := a.Run(port, path)
+	err = a.Run(port, path, cfg)
 	if err != nil {
 		panic(err)
 	}
 	common.InfoLogger.Println("Application runs")
 }
+
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
@@ -0,0 +1,44 @@
+// Command mockoidc runs a minimal OpenID Connect provider for trying external
+// login locally. Every authorization request is approved at once for the user
+// given on the command line.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"forum/internal/common"
+	"forum/internal/oidc/oidctest"
+	"net/http"
+)
+
+var (
+	port     int
+	clientID string
+	subject  string
+	email    string
+	login    string
+)
+
+func main() {
+	flag.IntVar(&port, "port", 9090, "Specify the provider port.")
+	flag.StringVar(&clientID, "client_id", "forum", "Specify the accepted client id")
+	flag.StringVar(&subject, "sub", "mock-user-1", "Specify the subject of the issued tokens")
+	flag.StringVar(&email, "email", "mock.user@example.com", "Specify the email of the issued tokens")
+	flag.StringVar(&login, "login", "mockuser", "Specify the preferred username of the issued tokens")
+	flag.Parse()
+
+	p := oidctest.NewProvider(fmt.Sprintf("http://localhost:%d", port), clientID)
+	p.SignIn(oidctest.Identity{
+		Subject:       subject,
+		Email:         email,
+		EmailVerified: true,
+		Login:         login,
+		GivenName:     "Mock",
+		FamilyName:    "User",
+	})
+
+	common.InfoLogger.Println("Mock OpenID provider runs at", p.Issuer)
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), p); err != nil {
+		panic(err)
+	}
+}
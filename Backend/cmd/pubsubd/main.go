@@ -0,0 +1,28 @@
+// Command pubsubd is a minimal stand-in for Redis pub/sub, for running several
+// forum instances locally without a Redis server. It understands PUBLISH,
+// SUBSCRIBE, UNSUBSCRIBE, PING and QUIT.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"forum/internal/broker/brokertest"
+	"forum/internal/common"
+	"net"
+)
+
+var port int
+
+func main() {
+	flag.IntVar(&port, "port", 6379, "Specify the port to listen on")
+	flag.Parse()
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		panic(err)
+	}
+	common.InfoLogger.Println("pub/sub stand-in listening at port:", port)
+	if err := brokertest.NewServer().Serve(ln); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,133 @@
+// Command wsload measures the fan-out latency of the websocket hub. It runs a
+// hub behind a local server, connects thousands of simulated clients, some of
+// which never read, broadcasts messages and reports how long the readers took
+// to receive them.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"forum/internal/chat"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	clients  int
+	slow     int
+	messages int
+	size     int
+	interval time.Duration
+	queue    int
+	timeout  time.Duration
+	policy   string
+)
+
+type probe struct {
+	Seq    int    `json:"seq"`
+	SentAt int64  `json:"sent_at"`
+	Pad    string `json:"pad"`
+}
+
+func main() {
+	flag.IntVar(&clients, "clients", 2000, "Specify how many clients connect")
+	flag.IntVar(&slow, "slow", 20, "Specify how many of the clients never read")
+	flag.IntVar(&messages, "messages", 200, "Specify how many messages are broadcast")
+	flag.IntVar(&size, "size", 1024, "Specify the message size in bytes")
+	flag.DurationVar(&interval, "interval", 5*time.Millisecond, "Specify the pause between broadcasts")
+	flag.IntVar(&queue, "queue", chat.DefaultHubOptions.QueueSize, "Specify the outbound queue size per client")
+	flag.DurationVar(&timeout, "write-timeout", chat.DefaultHubOptions.WriteTimeout, "Specify the write timeout")
+	flag.StringVar(&policy, "policy", string(chat.DefaultHubOptions.Policy), "Specify the slow consumer policy: drop or disconnect")
+	flag.Parse()
+
+	hub := chat.NewHub(chat.HubOptions{QueueSize: queue, WriteTimeout: timeout, Policy: chat.SlowConsumerPolicy(policy)})
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := hub.Register(r.URL.Query().Get("login"), conn)
+		defer hub.Unregister(c)
+		for {
+			if _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	var (
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, (clients-slow)*messages)
+		wg        sync.WaitGroup
+	)
+	conns := make([]*websocket.Conn, 0, clients)
+	start := time.Now()
+	for i := 0; i < clients; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s?login=client%d", url, i), nil)
+		if err != nil {
+			fmt.Println("dial:", err)
+			return
+		}
+		conns = append(conns, conn)
+		if i < slow {
+			continue
+		}
+		wg.Add(1)
+		go func(conn *websocket.Conn) {
+			defer wg.Done()
+			for n := 0; n < messages; n++ {
+				_ = conn.SetReadDeadline(time.Now().Add(timeout + 5*time.Second))
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				var p probe
+				if err := json.Unmarshal(data, &p); err != nil {
+					continue
+				}
+				d := time.Since(time.Unix(0, p.SentAt))
+				mu.Lock()
+				latencies = append(latencies, d)
+				mu.Unlock()
+			}
+		}(conn)
+	}
+	for hub.Stats().Clients < clients {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fmt.Printf("connected %d clients (%d slow) in %s\n", clients, slow, time.Since(start).Round(time.Millisecond))
+
+	pad := strings.Repeat("x", size)
+	start = time.Now()
+	for n := 0; n < messages; n++ {
+		hub.Broadcast(probe{Seq: n, SentAt: time.Now().UnixNano(), Pad: pad})
+		time.Sleep(interval)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	for _, c := range conns {
+		_ = c.Close()
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	expected := (clients - slow) * messages
+	fmt.Printf("broadcast %d messages of %d bytes in %s\n", messages, size, elapsed.Round(time.Millisecond))
+	fmt.Printf("received %d of %d by reading clients\n", len(latencies), expected)
+	if len(latencies) > 0 {
+		at := func(q float64) time.Duration {
+			return latencies[int(q*float64(len(latencies)-1))].Round(time.Microsecond)
+		}
+		fmt.Printf("latency p50=%s p90=%s p99=%s max=%s\n", at(0.5), at(0.9), at(0.99), at(1))
+	}
+	s := hub.Stats()
+	fmt.Printf("hub: sent=%d dropped=%d disconnected=%d\n", s.Sent, s.Dropped, s.Disconnected)
+}
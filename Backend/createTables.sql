@@ -7,7 +7,9 @@ create table if not exists users
     age integer not null,
     gender tinyint not null,
     first_name varchar(255) not null,
-    last_name varchar(255) not null
+    last_name varchar(255) not null,
+    role varchar(20) not null default 'user',
+    created_at timestamp default CURRENT_TIMESTAMP not null
 );
 
 create unique index if not exists "users_email_uindex"
@@ -84,28 +86,366 @@ create unique index if not exists sessions_session_id_uindex
 create unique index if not exists sessions_user_id_uindex
     on sessions (user_id);
 
+create table if not exists two_factor
+(
+    user_id        char(36)    not null
+        constraint two_factor_pk
+            primary key
+        constraint two_factor_users_id_fk
+            references users
+            on delete cascade,
+    secret         varchar(64) not null,
+    enabled        boolean     not null default false,
+    last_used_step integer     not null default 0,
+    created_at     timestamp   default CURRENT_TIMESTAMP not null
+);
+
+create table if not exists recovery_codes
+(
+    user_id   char(36)     not null
+        constraint recovery_codes_users_id_fk
+            references users
+            on delete cascade,
+    code_hash varchar(64)  not null,
+    used_at   timestamp    null,
+    constraint recovery_codes_pk
+        primary key (user_id, code_hash)
+);
+
+create table if not exists login_challenges
+(
+    challenge_key varchar(255) not null
+        constraint login_challenges_pk
+            primary key,
+    user_id       char(36)     not null
+        constraint login_challenges_users_id_fk
+            references users
+            on delete cascade,
+    attempts      integer      not null default 0,
+    expired_at    timestamp    not null
+);
+
+create table if not exists two_factor_policy
+(
+    role     varchar(20) not null
+        constraint two_factor_policy_pk
+            primary key,
+    required boolean     not null default false
+);
+
+create table if not exists user_identities
+(
+    provider   varchar(50)  not null,
+    subject    varchar(255) not null,
+    user_id    char(36)     not null
+        constraint user_identities_users_id_fk
+            references users
+            on delete cascade,
+    email      varchar(255) not null default '',
+    created_at timestamp    default CURRENT_TIMESTAMP not null,
+    constraint user_identities_pk
+        primary key (provider, subject)
+);
+
+create index if not exists user_identities_user_id_index
+    on user_identities (user_id);
+
+create table if not exists oauth_states
+(
+    state      varchar(255) not null
+        constraint oauth_states_pk
+            primary key,
+    provider   varchar(50)  not null,
+    nonce      varchar(255) not null,
+    verifier   varchar(255) not null,
+    user_id    char(36)     null
+        constraint oauth_states_users_id_fk
+            references users
+            on delete cascade,
+    expired_at timestamp    not null
+);
+
+create table if not exists api_tokens
+(
+    id           integer      not null
+        constraint api_tokens_pk
+            primary key autoincrement,
+    user_id      char(36)     not null
+        constraint api_tokens_users_id_fk
+            references users
+            on delete cascade,
+    name         varchar(100) not null,
+    token_hash   char(64)     not null,
+    scopes       varchar(255) not null,
+    created_at   timestamp    default CURRENT_TIMESTAMP not null,
+    expires_at   timestamp    not null,
+    last_used_at timestamp    null
+);
+
+create unique index if not exists api_tokens_token_hash_uindex
+    on api_tokens (token_hash);
+
+create index if not exists api_tokens_user_id_index
+    on api_tokens (user_id);
+
+create table if not exists account_deletions
+(
+    user_id      char(36)  not null
+        constraint account_deletions_pk
+            primary key
+        constraint account_deletions_users_id_fk
+            references users
+            on delete cascade,
+    requested_at timestamp default CURRENT_TIMESTAMP not null,
+    erase_after  timestamp not null
+);
+
+create table if not exists email_changes
+(
+    token_hash char(64)     not null
+        constraint email_changes_pk
+            primary key,
+    user_id    char(36)     not null
+        constraint email_changes_users_id_fk
+            references users
+            on delete cascade,
+    new_email  varchar(255) not null,
+    expired_at timestamp    not null
+);
+
+create table if not exists avatars
+(
+    user_id    char(36)  not null
+        constraint avatars_pk
+            primary key
+        constraint avatars_users_id_fk
+            references users
+            on delete cascade,
+    image      blob      not null,
+    updated_at timestamp default CURRENT_TIMESTAMP not null
+);
+
+create table if not exists login_attempts
+(
+    attempt_key  varchar(300) not null
+        constraint login_attempts_pk
+            primary key,
+    failures     integer      not null default 0,
+    last_failure timestamp    not null,
+    locked_until timestamp    null
+);
+
+create table if not exists account_unlocks
+(
+    token_hash char(64)  not null
+        constraint account_unlocks_pk
+            primary key,
+    user_id    char(36)  not null
+        constraint account_unlocks_users_id_fk
+            references users
+            on delete cascade,
+    expired_at timestamp not null
+);
+
+create table if not exists audit_events
+(
+    id         integer   not null
+        constraint audit_events_pk
+            primary key autoincrement,
+    event_type text      not null,
+    actor_id   char(36)  null,
+    target_id  char(36)  null,
+    ip         text      not null default '',
+    user_agent text      not null default '',
+    details    text      not null default '',
+    created_at timestamp not null
+);
+
+create index if not exists audit_events_created_at_index
+    on audit_events (created_at);
+
+create index if not exists audit_events_actor_id_index
+    on audit_events (actor_id);
+
+create index if not exists audit_events_target_id_index
+    on audit_events (target_id);
+
+create trigger if not exists audit_events_no_update
+    before update
+    on audit_events
+begin
+    select raise(abort, 'audit events are append-only');
+end;
+
+create trigger if not exists audit_events_no_delete
+    before delete
+    on audit_events
+begin
+    select raise(abort, 'audit events are append-only');
+end;
+
+create table if not exists user_blocks
+(
+    blocker_id       char(36)  not null
+        constraint user_blocks_blocker_fk
+            references users
+            on delete cascade,
+    blocked_id       char(36)  not null
+        constraint user_blocks_blocked_fk
+            references users
+            on delete cascade,
+    collapse_content boolean   not null default false,
+    created_at       timestamp not null,
+    constraint user_blocks_pk
+        primary key (blocker_id, blocked_id)
+);
+
+create table if not exists user_privacy
+(
+    user_id     char(36) not null
+        constraint user_privacy_pk
+            primary key
+        constraint user_privacy_users_id_fk
+            references users
+            on delete cascade,
+    listed      boolean  not null default true,
+    show_name   boolean  not null default true,
+    show_age    boolean  not null default false,
+    show_gender boolean  not null default false
+);
+
+create table if not exists conversations
+(
+    id          integer      not null
+        constraint conversations_pk
+            primary key autoincrement,
+    kind        varchar(10)  not null,
+    name        varchar(100) not null,
+    category_id integer      null
+        constraint conversations_categories_id_fk
+            references categories
+            on delete cascade,
+    created_by  char(36)     null
+        constraint conversations_users_id_fk
+            references users
+            on delete set null,
+    created_at  timestamp    not null
+);
+
+create unique index if not exists conversations_category_id_uindex
+    on conversations (category_id);
+
+create table if not exists conversation_members
+(
+    conversation_id integer     not null
+        constraint conversation_members_conversations_id_fk
+            references conversations
+            on delete cascade,
+    user_id         char(36)    not null
+        constraint conversation_members_users_id_fk
+            references users
+            on delete cascade,
+    role            varchar(10) not null default 'member',
+    joined_at       timestamp   not null,
+    constraint conversation_members_pk
+        primary key (conversation_id, user_id)
+);
+
+create index if not exists conversation_members_user_id_index
+    on conversation_members (user_id);
+
 create table if not exists chat
 (
     msg_id integer not null
         constraint chat_pk
             primary key autoincrement,
     msg_from char(36) not null,
-    msg_to char(36) not null,
+    msg_to char(36) null,
+    conversation_id integer null
+        constraint chat_conversations_id_fk
+            references conversations
+            on delete cascade,
     msg text not null,
-    send_at timestamp default CURRENT_TIMESTAMP not null
+    send_at timestamp default CURRENT_TIMESTAMP not null,
+    delivered_at timestamp null,
+    read_at timestamp null,
+    edited_at timestamp null,
+    deleted integer default 0 not null,
+    client_id varchar(64) null
 );
 
+create index if not exists chat_msg_to_msg_from_index
+    on chat (msg_to, msg_from);
+
+create index if not exists chat_conversation_id_index
+    on chat (conversation_id);
+
+create unique index if not exists chat_msg_from_client_id_uindex
+    on chat (msg_from, client_id)
+    where client_id is not null;
+
+create index if not exists chat_dm_index
+    on chat (min(msg_from, msg_to), max(msg_from, msg_to));
+
 create table if not exists online_status
 (
-    user_id char(36) not null
+    user_id       char(36)     not null
         constraint online_status_pk
-            primary key,
-    expires_at timestamp not null
+            primary key
+        constraint online_status_users_id_fk
+            references users
+            on delete cascade,
+    mode          varchar(20)  not null default 'online',
+    custom_status varchar(100) not null default '',
+    last_active   timestamp    not null,
+    last_seen     timestamp    null
 );
 
 create unique index if not exists online_status_user_id_uindex
     on online_status (user_id);
 
+create table if not exists presence_connections
+(
+    user_id     char(36)    not null
+        constraint presence_connections_users_id_fk
+            references users
+            on delete cascade,
+    instance_id varchar(36) not null,
+    heartbeat   timestamp   not null,
+    constraint presence_connections_pk
+        primary key (user_id, instance_id)
+);
+
+create index if not exists presence_connections_instance_id_index
+    on presence_connections (instance_id);
+
+create table if not exists event_sequences
+(
+    user_id  char(36) not null
+        constraint event_sequences_pk
+            primary key
+        constraint event_sequences_users_id_fk
+            references users
+            on delete cascade,
+    last_seq integer  not null default 0
+);
+
+create table if not exists user_events
+(
+    user_id    char(36)  not null
+        constraint user_events_users_id_fk
+            references users
+            on delete cascade,
+    seq        integer   not null,
+    payload    text      not null,
+    created_at timestamp not null,
+    constraint user_events_pk
+        primary key (user_id, seq)
+);
+
+create index if not exists user_events_created_at_index
+    on user_events (created_at);
+
 
 
 insert OR IGNORE into categories (id, name) values (1, 'Books'), (2, 'Films'), (3, 'Games'), (4, 'Other');
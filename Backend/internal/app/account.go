@@ -0,0 +1,139 @@
+package app
+
+import (
+	"encoding/json"
+	"forum/internal/audit"
+	"forum/internal/chat"
+	"forum/internal/common"
+	"forum/internal/post"
+	"forum/internal/user"
+	"net/http"
+	"time"
+)
+
+const eraseInterval = time.Hour
+
+//Account handlers
+
+type dataExport struct {
+	ExportedAt time.Time             `json:"exported_at"`
+	Profile    user.User             `json:"profile"`
+	Posts      []post.Post           `json:"posts"`
+	Comments   []post.Post           `json:"comments"`
+	Marks      []post.UserMark       `json:"marks"`
+	Messages   []chat.Message        `json:"messages"`
+	Identities []user.LinkedIdentity `json:"identities"`
+	Tokens     []user.Token          `json:"tokens"`
+}
+
+func (a *App) exportData(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	u, _ := r.Context().Value("user").(userContext)
+	export := dataExport{ExportedAt: time.Now(), Posts: []post.Post{}, Comments: []post.Post{}}
+
+	var err error
+	if export.Profile, err = a.userService.FindUser(u.userID); err != nil {
+		handleError(w, err)
+		return
+	}
+	all, err := a.postService.PostsOfUser(u.userID)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	for _, p := range all {
+		if p.ParentId == 0 {
+			export.Posts = append(export.Posts, p)
+		} else {
+			export.Comments = append(export.Comments, p)
+		}
+	}
+	if export.Marks, err = a.postService.MarksOfUser(u.userID); err != nil {
+		handleError(w, err)
+		return
+	}
+	if export.Messages, err = a.chatService.MessagesOfUser(u.userID); err != nil {
+		handleError(w, err)
+		return
+	}
+	if export.Identities, err = a.userService.LinkedIdentities(u.userID); err != nil {
+		handleError(w, err)
+		return
+	}
+	if export.Tokens, err = a.userService.ListTokens(u.userID); err != nil {
+		handleError(w, err)
+		return
+	}
+
+	common.InfoLogger.Printf("%s exported personal data", u.login)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+u.login+`-export.json"`)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(export); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	eraseAfter, err := a.userService.RequestDeletion(u.userID, req.Password)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	a.audit(r, audit.Event{Type: audit.DeletionRequested, TargetID: u.userID, Details: "erase after " + eraseAfter.Format(time.RFC3339)})
+	common.InfoLogger.Printf("%s requested account deletion, erasing after %s", u.login, eraseAfter)
+	http.SetCookie(w, &http.Cookie{Name: "session", Value: "", Path: "/", MaxAge: -1})
+
+	res := struct {
+		DeletionAt time.Time `json:"deletion_at"`
+	}{eraseAfter}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) cancelDeletion(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	u, _ := r.Context().Value("user").(userContext)
+	if err := a.userService.CancelDeletion(u.userID); err != nil {
+		handleError(w, err)
+		return
+	}
+	a.audit(r, audit.Event{Type: audit.DeletionCancelled, TargetID: u.userID})
+	common.InfoLogger.Printf("%s cancelled account deletion", u.login)
+}
+
+// eraseAccounts periodically erases the accounts whose grace period is over.
+func (a *App) eraseAccounts() {
+	ticker := time.NewTicker(eraseInterval)
+	defer ticker.Stop()
+	for {
+		erased, err := a.userService.EraseExpiredAccounts()
+		if err != nil {
+			common.ErrorLogger.Println(err)
+		} else if len(erased) > 0 {
+			common.InfoLogger.Printf("Erased %d accounts", len(erased))
+			// the erased users may still be connected
+			for _, login := range erased {
+				a.ws.Reconnect(login)
+			}
+			a.ws.SendListUsers()
+		}
+		<-ticker.C
+	}
+}
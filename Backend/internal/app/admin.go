@@ -0,0 +1,131 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"forum/internal/audit"
+	"forum/internal/common"
+	"forum/internal/user"
+	"net/http"
+)
+
+//Admin handlers
+
+func (a *App) adminUnlock(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	if err := a.userService.Unlock(req.Login, u.userID); err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("%s unlocked %s", u.login, req.Login)
+}
+
+func (a *App) setTwoFactorPolicy(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		Role     user.Role `json:"role"`
+		Required bool      `json:"required"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+
+	if err := a.userService.SetTwoFactorPolicy(req.Role, req.Required); err != nil {
+		handleError(w, err)
+		return
+	}
+	a.audit(r, audit.Event{Type: audit.TwoFactorPolicySet, Details: fmt.Sprintf("%s required=%v", req.Role, req.Required)})
+	common.InfoLogger.Printf("Two-factor requirement for %s set to %v", req.Role, req.Required)
+}
+
+func (a *App) passwordHashReport(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	report, err := a.userService.PasswordHashReport()
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("%d users are on legacy password hashes", report.Legacy)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) wsStats(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	if err := json.NewEncoder(w).Encode(a.ws.Stats()); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) setRole(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		Login string    `json:"login"`
+		Role  user.Role `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	target, err := a.userService.FindByCredential(req.Login)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if target.ID == u.userID {
+		handleError(w, common.InvalidArgumentError(nil, "you cannot change your own role"))
+		return
+	}
+	previous, err := a.userService.SetRole(target.ID, req.Role)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	a.audit(r, audit.Event{Type: audit.RoleChanged, TargetID: target.ID, Details: fmt.Sprintf("%s -> %s", previous, req.Role)})
+	common.InfoLogger.Printf("%s changed role of %s to %s", u.login, target.Login, req.Role)
+}
+
+func (a *App) revokeSessions(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	target, err := a.userService.FindByCredential(req.Login)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := a.userService.LogOut(target.ID); err != nil {
+		handleError(w, err)
+		return
+	}
+	a.audit(r, audit.Event{Type: audit.SessionsRevoked, TargetID: target.ID})
+	common.InfoLogger.Printf("%s revoked sessions of %s", u.login, target.Login)
+}
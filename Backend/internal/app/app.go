@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"forum/internal/audit"
+	"forum/internal/broker"
 	"forum/internal/chat"
 	"forum/internal/common"
+	"forum/internal/oidc"
 	"forum/internal/post"
 	"forum/internal/user"
 	"io/ioutil"
@@ -24,13 +27,27 @@ type App struct {
 	db          *sql.DB
 	router      *http.ServeMux
 	userService *user.Service
+	auditLog    *audit.Service
 	postService *post.Service
 	chatService *chat.Service
 	upgrader    websocket.Upgrader
 	ws          *chat.WS
+	providers   map[string]*oidc.Provider
 }
 
-func (a *App) Run(port int, path string) error {
+// Config holds the optional settings of the application.
+type Config struct {
+	OIDC     oidc.Config
+	Deletion user.DeletionPolicy
+	Password user.PasswordPolicy
+	Hash     user.HashParams
+	Hub      chat.HubOptions
+	// Broker is the address of the pub/sub server shared by the instances,
+	// empty for a single instance.
+	Broker string
+}
+
+func (a *App) Run(port int, path string, cfg Config) error {
 
 	//DB initialisation and connection
 	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on")
@@ -54,10 +71,46 @@ func (a *App) Run(port int, path string) error {
 	//user endpoints
 	a.router.HandleFunc("/register", a.register)
 	a.router.HandleFunc("/login", a.logIn)
-	a.router.Handle("/logout", a.userIdentity(a.logOut))
+	a.router.Handle("/logout", a.sessionOnly(a.logOut))
 	a.router.Handle("/profile", a.userIdentity(a.profile))
 	a.router.Handle("/auth", a.userIdentity(a.auth))
-	//a.router.Handle("/users", a.userIdentity(a.userList))
+	a.router.Handle("/profile/update", a.userIdentity(a.updateProfile))
+	a.router.Handle("/profile/login", a.sessionOnly(a.changeLogin))
+	a.router.Handle("/profile/password", a.sessionOnly(a.changePassword))
+	a.router.Handle("/profile/email", a.sessionOnly(a.changeEmail))
+	a.router.HandleFunc("/profile/email/verify", a.verifyEmail)
+	a.router.Handle("/profile/avatar", a.userIdentity(a.uploadAvatar))
+	a.router.HandleFunc("/avatar", a.avatar)
+	a.router.Handle("/profile/export", a.sessionOnly(a.exportData))
+	a.router.Handle("/profile/delete", a.sessionOnly(a.deleteAccount))
+	a.router.Handle("/profile/delete/cancel", a.sessionOnly(a.cancelDeletion))
+	a.router.HandleFunc("/login/2fa", a.logInTwoFactor)
+	a.router.HandleFunc("/login/unlock", a.unlockAccount)
+	a.router.Handle("/2fa/enroll", a.sessionOnly(a.enrollTwoFactor))
+	a.router.Handle("/2fa/confirm", a.sessionOnly(a.confirmTwoFactor))
+	a.router.Handle("/2fa/disable", a.sessionOnly(a.disableTwoFactor))
+	a.router.Handle("/2fa/recovery_codes", a.sessionOnly(a.regenerateRecoveryCodes))
+	a.router.Handle("/profile/privacy", a.userIdentity(a.privacy))
+	a.router.Handle("/profile/presence", a.userIdentity(a.setPresence, user.ScopeChat))
+	a.router.Handle("/users", a.userIdentity(a.userList))
+	a.router.Handle("/users/search", a.userIdentity(a.searchUsers))
+	a.router.HandleFunc("/users/profile", a.publicProfile)
+	a.router.HandleFunc("/users/posts", a.userPosts)
+	a.router.HandleFunc("/users/comments", a.userComments)
+
+	//external login endpoints
+	a.router.HandleFunc("/oauth/providers", a.oauthProviders)
+	a.router.HandleFunc("/oauth/login", a.oauthLogin)
+	a.router.HandleFunc("/oauth/callback", a.oauthCallback)
+	a.router.Handle("/oauth/link", a.sessionOnly(a.oauthLink))
+	a.router.Handle("/oauth/unlink", a.sessionOnly(a.oauthUnlink))
+	a.router.Handle("/oauth/identities", a.sessionOnly(a.oauthIdentities))
+	a.router.Handle("/tokens", a.sessionOnly(a.listTokens))
+	a.router.Handle("/tokens/new", a.sessionOnly(a.createToken))
+	a.router.Handle("/tokens/revoke", a.sessionOnly(a.revokeToken))
+	a.router.Handle("/blocks", a.userIdentity(a.blockedUsers))
+	a.router.Handle("/blocks/add", a.userIdentity(a.blockUser))
+	a.router.Handle("/blocks/remove", a.userIdentity(a.unblockUser))
 
 	//post endpoints
 	a.router.Handle("/post/new", a.userIdentity(a.addPost))
@@ -70,22 +123,66 @@ func (a *App) Run(port int, path string) error {
 	a.router.HandleFunc("/post", a.findByID)
 	a.router.HandleFunc("/post/comments", a.findComments)
 
+	//admin endpoints
+	a.router.Handle("/admin/2fa_policy", a.requireRole(a.setTwoFactorPolicy, user.RoleAdmin))
+	a.router.Handle("/admin/unlock", a.requireRole(a.adminUnlock, user.RoleAdmin, user.RoleModerator))
+	a.router.Handle("/admin/password_hashes", a.requireRole(a.passwordHashReport, user.RoleAdmin))
+	a.router.Handle("/admin/ws_stats", a.requireRole(a.wsStats, user.RoleAdmin))
+	a.router.Handle("/admin/role", a.requireRole(a.setRole, user.RoleAdmin))
+	a.router.Handle("/admin/sessions/revoke", a.requireRole(a.revokeSessions, user.RoleAdmin, user.RoleModerator))
+	a.router.Handle("/admin/audit", a.requireRole(a.auditEvents, user.RoleAdmin))
+	a.router.Handle("/admin/audit/export", a.requireRole(a.exportAuditEvents, user.RoleAdmin))
+
 	//connection to file server
 	fs := http.FileServer(http.Dir("../Frontend/app"))
 	a.router.Handle("/", fs)
-	a.router.Handle("/ws", a.userIdentity(a.handleConnections))
-
-	a.router.Handle("/chat", a.userIdentity(a.getMessages))
-
+	a.router.Handle("/ws", a.userIdentity(a.handleConnections, user.ScopeChat))
+	a.router.HandleFunc("/ws/schema", a.wsSchema)
+
+	a.router.Handle("/chat", a.userIdentity(a.getMessages, user.ScopeChat))
+	a.router.Handle("/chat/search", a.userIdentity(a.searchMessages, user.ScopeChat))
+	a.router.Handle("/conversations", a.userIdentity(a.conversations, user.ScopeChat))
+	a.router.Handle("/conversations/new", a.userIdentity(a.createConversation, user.ScopeChat))
+	a.router.Handle("/conversations/invite", a.userIdentity(a.inviteToConversation, user.ScopeChat))
+	a.router.Handle("/conversations/remove", a.userIdentity(a.removeFromConversation, user.ScopeChat))
+	a.router.Handle("/conversations/leave", a.userIdentity(a.leaveConversation, user.ScopeChat))
+	a.router.Handle("/conversations/rooms", a.userIdentity(a.chatRooms, user.ScopeChat))
+	a.router.Handle("/conversations/join", a.userIdentity(a.joinRoom, user.ScopeChat))
+	a.router.Handle("/conversations/messages", a.userIdentity(a.conversationMessages, user.ScopeChat))
+
+	a.auditLog = audit.NewService(a.db)
 	a.userService = user.NewService(a.db)
+	a.userService.SetEventHandler(a.recordSecurityEvent)
+	if cfg.Deletion.GracePeriod > 0 {
+		a.userService.SetDeletionPolicy(cfg.Deletion)
+	}
+	if cfg.Password.MinLength > 0 {
+		a.userService.SetPasswordPolicy(cfg.Password)
+	}
+	if cfg.Hash.Algorithm != "" {
+		a.userService.SetHashParams(cfg.Hash)
+	}
 	a.postService = post.NewService(a.db)
 	a.chatService = chat.NewService(a.db, a.userService)
-	a.ws = chat.NewWS(a.userService, a.chatService)
+	events, err := broker.New(cfg.Broker)
+	if err != nil {
+		return err
+	}
+	a.ws = chat.NewWS(a.userService, a.chatService, cfg.Hub, events)
+
+	go a.eraseAccounts()
+
+	a.providers = make(map[string]*oidc.Provider)
+	for _, pc := range cfg.OIDC.Providers {
+		a.providers[pc.Name] = oidc.NewProvider(pc)
+		common.InfoLogger.Println("External login enabled for", pc.Name)
+	}
 
 	//ws
 	a.upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		Subprotocols:    []string{chat.ProtocolName},
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
@@ -96,6 +193,9 @@ func (a *App) Run(port int, path string) error {
 }
 
 func (a *App) createDB() error {
+	if err := a.migrate(); err != nil {
+		return err
+	}
 	createDB, err := ioutil.ReadFile("./createTables.sql")
 	if err != nil {
 		return err
@@ -106,7 +206,7 @@ func (a *App) createDB() error {
 		return err
 	}
 
-	return nil
+	return a.createDeletedUser()
 }
 
 func setHeaders(w http.ResponseWriter) {
@@ -154,22 +254,48 @@ func (a *App) logIn(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	code, err := a.userService.NewSession(loginReq.Credential, loginReq.Password)
+	res, err := a.userService.NewSession(loginReq.Credential, loginReq.Password, client(r))
 	if err != nil {
 		handleError(w, err)
 		return
 	}
-	fmt.Printf(code)
+	if res.Challenge != "" {
+		common.InfoLogger.Printf("%s has to pass two-factor check", loginReq.Credential)
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			handleError(w, err)
+		}
+		return
+	}
+	setSessionCookie(w, res)
+	a.audit(r, audit.Event{Type: audit.Login, ActorID: res.UserID, TargetID: res.UserID})
+	common.InfoLogger.Printf("%s logged in", loginReq.Credential)
+}
+
+func setSessionCookie(w http.ResponseWriter, res user.LoginResult) {
 	c := http.Cookie{
 		Name:    "session",
-		Value:   code,
+		Value:   res.Session,
 		Expires: time.Now().AddDate(0, 0, 1),
 		Path:    "/",
 	}
 
 	common.InfoLogger.Println("Setting cookie", c)
 	http.SetCookie(w, &c)
-	common.InfoLogger.Printf("%s logged in", loginReq.Credential)
+	if res.TwoFactorSetup {
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			handleError(w, err)
+		}
+	}
+}
+
+func (a *App) unlockAccount(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	if err := a.userService.UnlockWithToken(r.URL.Query().Get("token")); err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Println("Account unlocked by email link")
 }
 
 func (a *App) logOut(w http.ResponseWriter, r *http.Request) {
@@ -183,6 +309,7 @@ func (a *App) logOut(w http.ResponseWriter, r *http.Request) {
 		handleError(w, err)
 		return
 	}
+	a.audit(r, audit.Event{Type: audit.Logout, TargetID: values.userID})
 
 	common.InfoLogger.Printf("User %s logged out", values.login)
 }
@@ -217,6 +344,7 @@ func (a *App) auth(w http.ResponseWriter, r *http.Request) {
 	u.ID = val.userID
 	u.Email = val.email
 	u.Login = val.login
+	u.Role = val.role
 	fmt.Println(u)
 
 	if err := json.NewEncoder(w).Encode(u); err != nil {
@@ -263,6 +391,7 @@ func (a *App) allPosts(w http.ResponseWriter, r *http.Request) {
 		handleError(w, err)
 		return
 	}
+	a.collapseBlocked(r, allPosts)
 	common.InfoLogger.Println("Get All Posts")
 	if err := json.NewEncoder(w).Encode(allPosts); err != nil {
 		handleError(w, err)
@@ -321,6 +450,7 @@ func (a *App) findByCategory(w http.ResponseWriter, r *http.Request) {
 		handleError(w, err)
 		return
 	}
+	a.collapseBlocked(r, posts)
 
 	if len(posts) == 0 {
 		common.InfoLogger.Println("No posts with that category")
@@ -402,6 +532,7 @@ func (a *App) findByID(w http.ResponseWriter, r *http.Request) {
 		handleError(w, err)
 		return
 	}
+	a.collapseBlockedPost(r, &post)
 	common.InfoLogger.Println("Post found")
 	if err := json.NewEncoder(w).Encode(post); err != nil {
 		handleError(w, err)
@@ -424,6 +555,7 @@ func (a *App) findComments(w http.ResponseWriter, r *http.Request) {
 		handleError(w, err)
 		return
 	}
+	a.collapseBlocked(r, comments)
 	if comments == nil {
 		common.InfoLogger.Println("No comments")
 		return
@@ -437,21 +569,6 @@ func (a *App) findComments(w http.ResponseWriter, r *http.Request) {
 
 //Chat handlers
 
-//func (a *App) userList(w http.ResponseWriter, r *http.Request) {
-//	setHeaders(w)
-//	allUsers, err := a.userService.FindAllUsers()
-//	if err != nil {
-//		handleError(w, err)
-//		return
-//	}
-//	common.InfoLogger.Println("Got list of users")
-//
-//	if err := json.NewEncoder(w).Encode(allUsers); err != nil {
-//		handleError(w, err)
-//		return
-//	}
-//}
-
 func (a *App) getMessages(w http.ResponseWriter, r *http.Request) {
 	setHeaders(w)
 	val, _ := r.Context().Value("user").(userContext)
@@ -459,31 +576,20 @@ func (a *App) getMessages(w http.ResponseWriter, r *http.Request) {
 	//setting values from context
 	sender := val.userID
 	receiver := r.URL.Query().Get("with")
-	skip := r.URL.Query().Get("skip")
-	limit := r.URL.Query().Get("limit")
-	intSkip, _ := strconv.Atoi(skip)
-	intLimit, _ := strconv.Atoi(limit)
-
-	countMessages, err := a.chatService.CountMessages(sender, receiver)
-
+	q, err := historyParams(r)
 	if err != nil {
 		handleError(w, err)
 		return
 	}
 
-	messages, err := a.chatService.GetMessages(sender, receiver, intSkip, intLimit)
+	history, err := a.chatService.History(sender, receiver, q)
 	if err != nil {
 		handleError(w, err)
 		return
 	}
-	common.InfoLogger.Printf("Got %d messages between %s and %s", len(messages), sender, receiver)
-
-	type res struct {
-		Messages []chat.Message `json:"messages"`
-		Count    int            `json:"count"`
-	}
+	common.InfoLogger.Printf("Got %d messages between %s and %s", len(history.Messages), sender, receiver)
 
-	if err := json.NewEncoder(w).Encode(res{messages, countMessages}); err != nil {
+	if err := json.NewEncoder(w).Encode(history); err != nil {
 		handleError(w, err)
 		return
 	}
@@ -497,15 +603,27 @@ func (a *App) handleConnections(w http.ResponseWriter, r *http.Request) {
 	login := val.login
 	ws, err := a.upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		// Upgrade has replied with the error
 		log.Println(err)
+		return
 	}
-	if err := a.ws.StartListener(ws, login); err != nil {
-		handleError(w, err)
+	if err := a.ws.StartListener(ws, val.userID, login); err != nil {
+		// the connection is hijacked, so the error cannot be sent as a response
+		common.ErrorLogger.Println(err)
+		ws.Close()
 		return
 	}
 	common.InfoLogger.Println("Client connected to endpoint successfully")
 }
 
+// wsSchema publishes the JSON Schema of the version 2 websocket protocol.
+func (a *App) wsSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	if _, err := w.Write(chat.Schema); err != nil {
+		common.ErrorLogger.Println(err)
+	}
+}
+
 //Error handler
 func handleError(w http.ResponseWriter, err error) {
 
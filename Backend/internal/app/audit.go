@@ -0,0 +1,120 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"forum/internal/audit"
+	"forum/internal/common"
+	"forum/internal/user"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Audit handlers
+
+// audit records an event done by the user of the request, from the request's
+// address.
+func (a *App) audit(r *http.Request, e audit.Event) {
+	if u, ok := r.Context().Value("user").(userContext); ok && e.ActorID == "" {
+		e.ActorID = u.userID
+	}
+	e.IP = clientIP(r)
+	e.UserAgent = r.UserAgent()
+	if err := a.auditLog.Record(e); err != nil {
+		common.ErrorLogger.Println(err)
+	}
+}
+
+// recordSecurityEvent stores the security events of the user service.
+func (a *App) recordSecurityEvent(e user.SecurityEvent) {
+	common.WarningLogger.Printf("security event %s: user=%q login=%q ip=%s %s", e.Type, e.UserID, e.Login, e.IP, e.Details)
+	details := e.Details
+	if e.UserID == "" && e.Login != "" {
+		details = strings.TrimSpace(fmt.Sprintf("login %q %s", e.Login, details))
+	}
+	err := a.auditLog.Record(audit.Event{
+		Type:      string(e.Type),
+		ActorID:   e.ActorID,
+		TargetID:  e.UserID,
+		IP:        e.IP,
+		UserAgent: e.UserAgent,
+		Details:   details,
+		CreatedAt: e.Time,
+	})
+	if err != nil {
+		common.ErrorLogger.Println(err)
+	}
+}
+
+func client(r *http.Request) user.Client {
+	return user.Client{IP: clientIP(r), UserAgent: r.UserAgent()}
+}
+
+// auditFilter reads the filter from the query: type, user (login or id), ip,
+// from and to (RFC 3339), page and limit.
+func (a *App) auditFilter(r *http.Request) (audit.Filter, error) {
+	q := r.URL.Query()
+	f := audit.Filter{Type: q.Get("type"), IP: q.Get("ip")}
+
+	if login := q.Get("user"); login != "" {
+		f.UserID = login
+		if u, err := a.userService.FindByCredential(login); err == nil {
+			f.UserID = u.ID
+		}
+	}
+	for _, t := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		if v := q.Get(t.name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return audit.Filter{}, common.InvalidArgumentError(err, t.name+" must be an RFC 3339 time")
+			}
+			*t.dst = parsed
+		}
+	}
+	var err error
+	if f.Page, f.Limit, err = pageParams(r); err != nil {
+		return audit.Filter{}, err
+	}
+	return f, nil
+}
+
+func (a *App) auditEvents(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	f, err := a.auditFilter(r)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	page, err := a.auditLog.Find(f)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) exportAuditEvents(w http.ResponseWriter, r *http.Request) {
+	f, err := a.auditFilter(r)
+	if err != nil {
+		setHeaders(w)
+		handleError(w, err)
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	if err := a.auditLog.Export(f, w); err != nil {
+		common.ErrorLogger.Println(err)
+		return
+	}
+	common.InfoLogger.Printf("%s exported the audit log", u.login)
+}
@@ -0,0 +1,88 @@
+package app
+
+import (
+	"encoding/json"
+	"forum/internal/common"
+	"forum/internal/post"
+	"net/http"
+)
+
+//Block handlers
+
+func (a *App) blockedUsers(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	u, _ := r.Context().Value("user").(userContext)
+	blocked, err := a.userService.BlockedUsers(u.userID)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(blocked); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) blockUser(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		Login           string `json:"login"`
+		CollapseContent bool   `json:"collapse_content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	blocked, err := a.userService.BlockUser(u.userID, req.Login, req.CollapseContent)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("%s blocked %s", u.login, blocked.Login)
+	a.ws.SendListUsers()
+	if err := json.NewEncoder(w).Encode(blocked); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) unblockUser(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	if err := a.userService.UnblockUser(u.userID, req.Login); err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("%s unblocked %s", u.login, req.Login)
+	a.ws.SendListUsers()
+}
+
+// collapseBlocked marks the posts of users the viewer blocked with collapsed
+// content. Anonymous viewers see everything expanded.
+func (a *App) collapseBlocked(r *http.Request, posts []post.PostAndMarks) {
+	authors, err := a.userService.CollapsedAuthors(a.viewerID(r))
+	if err != nil {
+		common.ErrorLogger.Println(err)
+		return
+	}
+	post.Collapse(posts, authors)
+}
+
+func (a *App) collapseBlockedPost(r *http.Request, p *post.PostAndMarks) {
+	posts := []post.PostAndMarks{*p}
+	a.collapseBlocked(r, posts)
+	*p = posts[0]
+}
@@ -0,0 +1,206 @@
+package app
+
+import (
+	"encoding/json"
+	"forum/internal/chat"
+	"forum/internal/common"
+	"net/http"
+	"strconv"
+)
+
+//Conversation handlers
+
+type conversationRequest struct {
+	ConversationID int    `json:"conversation_id"`
+	Login          string `json:"login"`
+}
+
+func (a *App) conversations(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	u, _ := r.Context().Value("user").(userContext)
+	convs, err := a.chatService.Conversations(u.userID)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(convs); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) createConversation(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		Name    string   `json:"name"`
+		Members []string `json:"members"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	c, err := a.chatService.CreateGroup(u.userID, req.Name, req.Members)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("%s created conversation %d", u.login, c.ID)
+	a.ws.PushConversation(c)
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) inviteToConversation(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req conversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	c, err := a.chatService.Invite(u.userID, req.ConversationID, req.Login)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("%s invited %s to conversation %d", u.login, req.Login, c.ID)
+	a.ws.PushConversation(c)
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) removeFromConversation(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req conversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	c, err := a.chatService.RemoveMember(u.userID, req.ConversationID, req.Login)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("%s removed %s from conversation %d", u.login, req.Login, c.ID)
+	a.ws.PushConversation(c, req.Login)
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) leaveConversation(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req conversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	c, err := a.chatService.Leave(u.userID, req.ConversationID)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("%s left conversation %d", u.login, c.ID)
+	a.ws.PushConversation(c, u.login)
+}
+
+func (a *App) chatRooms(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	rooms, err := a.chatService.Rooms()
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(rooms); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) joinRoom(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req conversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	c, err := a.chatService.JoinRoom(u.userID, req.ConversationID)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("%s joined room %d", u.login, c.ID)
+	a.ws.PushConversation(c)
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) conversationMessages(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid conversation id"))
+		return
+	}
+	q, err := historyParams(r)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	history, err := a.chatService.ConversationHistory(u.userID, id, q)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("Got %d messages of conversation %d", len(history.Messages), id)
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+// historyParams reads the before, after, around and limit parameters of a
+// history request.
+func historyParams(r *http.Request) (chat.HistoryQuery, error) {
+	var q chat.HistoryQuery
+	params := r.URL.Query()
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"before", &q.Before}, {"after", &q.After}, {"around", &q.Around}, {"limit", &q.Limit}} {
+		if v := params.Get(p.name); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed < 1 {
+				return chat.HistoryQuery{}, common.InvalidArgumentError(err, p.name+" must be a positive number")
+			}
+			*p.dst = parsed
+		}
+	}
+	return q, nil
+}
@@ -0,0 +1,146 @@
+package app
+
+import (
+	"encoding/json"
+	"forum/internal/common"
+	"forum/internal/post"
+	"forum/internal/user"
+	"net/http"
+	"strconv"
+)
+
+//Directory handlers
+
+func (a *App) searchUsers(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("q") == "" {
+		setHeaders(w)
+		handleError(w, common.InvalidArgumentError(nil, "search query is required"))
+		return
+	}
+	a.userList(w, r)
+}
+
+// userList returns a page of the user directory, filtered by the optional
+// q prefix.
+func (a *App) userList(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	page, limit, err := pageParams(r)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	res, err := a.userService.Directory(r.URL.Query().Get("q"), page, limit)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("Got %d users from the directory", len(res.Users))
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) privacy(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	u, _ := r.Context().Value("user").(userContext)
+	if r.Method == http.MethodPost {
+		var p user.Privacy
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			handleError(w, common.InvalidArgumentError(err, "invalid json"))
+			return
+		}
+		if err := a.userService.SetPrivacy(u.userID, p); err != nil {
+			handleError(w, err)
+			return
+		}
+		common.InfoLogger.Printf("%s changed privacy settings", u.login)
+	}
+
+	p, err := a.userService.Privacy(u.userID)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) publicProfile(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	u, err := a.userService.PublicProfile(r.URL.Query().Get("login"))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	stats, err := a.postService.UserStats(u.ID)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	res := struct {
+		user.PublicUser
+		Stats post.UserStats `json:"stats"`
+	}{u, stats}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) userPosts(w http.ResponseWriter, r *http.Request) {
+	a.listUserPosts(w, r, false)
+}
+
+func (a *App) userComments(w http.ResponseWriter, r *http.Request) {
+	a.listUserPosts(w, r, true)
+}
+
+func (a *App) listUserPosts(w http.ResponseWriter, r *http.Request, comments bool) {
+	setHeaders(w)
+
+	page, limit, err := pageParams(r)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	u, err := a.userService.PublicProfile(r.URL.Query().Get("login"))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	res, err := a.postService.UserPosts(u.ID, comments, page, limit)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	a.collapseBlocked(r, res.Posts)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+// pageParams reads the optional page and limit query parameters. Zero means
+// the default of the listing.
+func pageParams(r *http.Request) (page, limit int, err error) {
+	q := r.URL.Query()
+	for _, n := range []struct {
+		name string
+		dst  *int
+	}{{"page", &page}, {"limit", &limit}} {
+		if v := q.Get(n.name); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed < 1 {
+				return 0, 0, common.InvalidArgumentError(err, n.name+" must be a positive number")
+			}
+			*n.dst = parsed
+		}
+	}
+	return page, limit, nil
+}
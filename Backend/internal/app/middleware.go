@@ -3,7 +3,9 @@ package app
 import (
 	"context"
 	"fmt"
+	"forum/internal/common"
 	"forum/internal/user"
+	"net"
 	"net/http"
 	"strings"
 )
@@ -12,10 +14,21 @@ type userContext struct {
 	userID string
 	login  string
 	email  string
+	role   user.Role
+	token  *user.Token
 }
 
-func (a *App) userIdentity(next http.HandlerFunc) http.Handler {
+// userIdentity authenticates the request by the session cookie or by a
+// personal access token in the Authorization header. Tokens must carry one of
+// the scopes; without explicit scopes, reading requests need the read scope
+// and everything else the write scope.
+func (a *App) userIdentity(next http.HandlerFunc, scopes ...user.Scope) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			a.tokenIdentity(w, r, next, auth, scopes)
+			return
+		}
+
 		c, err := r.Cookie("session")
 		fmt.Println(c)
 		if err != nil {
@@ -42,11 +55,126 @@ func (a *App) userIdentity(next http.HandlerFunc) http.Handler {
 		//}
 		//fmt.Println(u.Login, "status updated")
 		// set context
-		ctx := context.WithValue(r.Context(), "user", userContext{userID: u.ID, login: u.Login, email: u.Email})
+		ctx := context.WithValue(r.Context(), "user", userContext{userID: u.ID, login: u.Login, email: u.Email, role: u.Role})
 		next(w, r.WithContext(ctx))
 	})
 }
 
+func (a *App) tokenIdentity(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, auth string, scopes []user.Scope) {
+	value, ok := bearerToken(auth)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	u, t, err := a.userService.CheckToken(value)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if len(scopes) == 0 {
+		scopes = []user.Scope{user.ScopeWrite}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			scopes = []user.Scope{user.ScopeRead}
+		}
+	}
+	allowed := false
+	for _, sc := range scopes {
+		if t.HasScope(sc) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		handleError(w, common.NewAppError(nil, "token does not have the required scope", http.StatusForbidden))
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), "user", userContext{userID: u.ID, login: u.Login, email: u.Email, role: u.Role, token: &t})
+	next(w, r.WithContext(ctx))
+}
+
+// bearerToken returns the token of a "Bearer" Authorization header.
+func bearerToken(auth string) (string, bool) {
+	value := strings.TrimPrefix(auth, "Bearer ")
+	return value, value != auth
+}
+
+// sessionOnly rejects requests authenticated with a personal access token, for
+// endpoints which manage the account itself.
+func (a *App) sessionOnly(next http.HandlerFunc) http.Handler {
+	return a.userIdentity(func(w http.ResponseWriter, r *http.Request) {
+		u, _ := r.Context().Value("user").(userContext)
+		if u.token != nil {
+			handleError(w, common.NewAppError(nil, "this action requires a logged in session", http.StatusForbidden))
+			return
+		}
+		next(w, r)
+	})
+}
+
+// requireRole lets the request through only for users with one of the roles.
+// Privileged users also have to satisfy the two-factor policy of their role.
+func (a *App) requireRole(next http.HandlerFunc, roles ...user.Role) http.Handler {
+	return a.sessionOnly(func(w http.ResponseWriter, r *http.Request) {
+		u, _ := r.Context().Value("user").(userContext)
+		allowed := false
+		for _, role := range roles {
+			if u.role == role {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			handleError(w, common.ForbiddenError)
+			return
+		}
+		if err := a.userService.CheckTwoFactorPolicy(u.userID, u.role); err != nil {
+			handleError(w, err)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// viewerID returns the user who sent the request to a public endpoint, or an
+// empty string for anonymous requests.
+func (a *App) viewerID(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		value, ok := bearerToken(auth)
+		if !ok {
+			return ""
+		}
+		u, _, err := a.userService.CheckToken(value)
+		if err != nil {
+			return ""
+		}
+		return u.ID
+	}
+	c, err := r.Cookie("session")
+	if err != nil {
+		return ""
+	}
+	xs := strings.SplitN(c.Value, "|", 2)
+	if len(xs) != 2 {
+		return ""
+	}
+	u, err := a.userService.CheckSession(xs[0], xs[1])
+	if err != nil {
+		return ""
+	}
+	return u.ID
+}
+
+// clientIP returns the address of the client which sent the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func corsMW(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
@@ -56,7 +184,7 @@ func corsMW(next http.Handler) http.Handler {
 		w.Header().Set("Access-Control-Allow-Origin", origin)
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, *")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Authorization, *")
 		if r.Method != http.MethodOptions {
 			next.ServeHTTP(w, r)
 		}
@@ -0,0 +1,165 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"forum/internal/user"
+)
+
+// migration brings a table created by an earlier createTables.sql up to date.
+// It runs when the table exists without the column; new databases get the
+// column from createTables.sql, which runs after the migrations.
+type migration struct {
+	table  string
+	column string
+	stmts  []string
+}
+
+// migrations are applied in order, each in a transaction.
+var migrations = []migration{
+	{"users", "role", []string{
+		`alter table users add column role varchar(20) not null default 'user'`,
+	}},
+	// SQLite only adds columns with a constant default; the accounts get the
+	// time of their first post, or of the migration.
+	{"users", "created_at", []string{
+		`alter table users add column created_at timestamp not null default '1970-01-01 00:00:00'`,
+		`update users set created_at = coalesce((select min(p.created_at) from posts p where p.user_id = users.id), CURRENT_TIMESTAMP)`,
+	}},
+	// online_status only had the expiry of the last activity; presence is
+	// rebuilt from it, everyone offline.
+	{"online_status", "mode", []string{
+		`create table online_status_rebuild
+(
+    user_id       char(36)     not null
+        constraint online_status_pk
+            primary key
+        constraint online_status_users_id_fk
+            references users
+            on delete cascade,
+    mode          varchar(20)  not null default 'online',
+    custom_status varchar(100) not null default '',
+    last_active   timestamp    not null,
+    last_seen     timestamp    null
+)`,
+		`insert into online_status_rebuild (user_id, last_active, last_seen)
+select user_id, expires_at, expires_at from online_status where user_id in (select id from users)`,
+		`drop table online_status`,
+		`alter table online_status_rebuild rename to online_status`,
+	}},
+	// messages from before the receipts count as delivered and read, so
+	// they do not show up as unread
+	{"chat", "delivered_at", []string{
+		`alter table chat add column delivered_at timestamp null`,
+		`alter table chat add column read_at timestamp null`,
+		`update chat set delivered_at = send_at, read_at = send_at`,
+	}},
+	// direct messages keep their receiver; messages of conversations have
+	// none, which takes a rebuild to allow
+	{"chat", "conversation_id", []string{
+		`create table chat_rebuild
+(
+    msg_id integer not null
+        constraint chat_pk
+            primary key autoincrement,
+    msg_from char(36) not null,
+    msg_to char(36) null,
+    conversation_id integer null
+        constraint chat_conversations_id_fk
+            references conversations
+            on delete cascade,
+    msg text not null,
+    send_at timestamp default CURRENT_TIMESTAMP not null,
+    delivered_at timestamp null,
+    read_at timestamp null
+)`,
+		`insert into chat_rebuild (msg_id, msg_from, msg_to, msg, send_at, delivered_at, read_at)
+select msg_id, msg_from, msg_to, msg, send_at, delivered_at, read_at from chat`,
+		`drop table chat`,
+		`alter table chat_rebuild rename to chat`,
+	}},
+	{"chat", "edited_at", []string{
+		`alter table chat add column edited_at timestamp null`,
+		`alter table chat add column deleted integer default 0 not null`,
+	}},
+	// the unique index on (msg_from, client_id) comes from createTables.sql
+	{"chat", "client_id", []string{
+		`alter table chat add column client_id varchar(64) null`,
+	}},
+}
+
+// migrate runs the migrations on a connection of its own with the foreign keys
+// off, as SQLite asks for table rebuilds: the rebuilt tables may reference
+// tables createTables.sql has not created yet.
+func (a *App) migrate() error {
+	ctx := context.Background()
+	conn, err := a.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys=off`); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `PRAGMA foreign_keys=on`)
+
+	for _, m := range migrations {
+		needed, err := missingColumn(ctx, conn, m.table, m.column)
+		if err != nil {
+			return err
+		}
+		if !needed {
+			continue
+		}
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range m.stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migrating %s.%s: %w", m.table, m.column, err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createDeletedUser creates the placeholder account which takes over the posts
+// of erased users. Accounts cannot be erased without it, so the start fails
+// when another account has its login or email.
+func (a *App) createDeletedUser() error {
+	_, err := a.db.Exec(`INSERT INTO users (id, email, login, password, age, gender, first_name, last_name)
+VALUES ($1, 'deleted@localhost', 'deleted', '', 0, 0, 'Deleted', 'User')
+ON CONFLICT (id) DO NOTHING`, user.DeletedUserID)
+	if err != nil {
+		return fmt.Errorf("creating the placeholder account of erased users, rename the account with the login deleted or the email deleted@localhost: %w", err)
+	}
+	return nil
+}
+
+// missingColumn reports whether the table exists without the column.
+func missingColumn(ctx context.Context, conn *sql.Conn, table, column string) (bool, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT name FROM pragma_table_info($1)`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	exists := false
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
+		exists = true
+	}
+	return exists, rows.Err()
+}
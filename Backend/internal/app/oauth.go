@@ -0,0 +1,172 @@
+package app
+
+import (
+	"encoding/json"
+	"forum/internal/audit"
+	"forum/internal/common"
+	"forum/internal/oidc"
+	"forum/internal/user"
+	"net/http"
+	"sort"
+)
+
+//External login handlers
+
+func (a *App) oauthProviders(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	names := make([]string, 0, len(a.providers))
+	for name := range a.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if err := json.NewEncoder(w).Encode(names); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) oauthLogin(w http.ResponseWriter, r *http.Request) {
+	a.startExternalLogin(w, r, "")
+}
+
+func (a *App) oauthLink(w http.ResponseWriter, r *http.Request) {
+	u, _ := r.Context().Value("user").(userContext)
+	a.startExternalLogin(w, r, u.userID)
+}
+
+// startExternalLogin remembers the PKCE verifier, nonce and state of the login
+// and redirects the browser to the provider.
+func (a *App) startExternalLogin(w http.ResponseWriter, r *http.Request, userID string) {
+	p, ok := a.providers[r.URL.Query().Get("provider")]
+	if !ok {
+		setHeaders(w)
+		handleError(w, common.NotFoundError(nil, "unknown identity provider"))
+		return
+	}
+
+	req, err := oidc.NewAuthRequest()
+	if err != nil {
+		setHeaders(w)
+		handleError(w, common.SystemError(err))
+		return
+	}
+	authURL, err := p.AuthURL(req)
+	if err != nil {
+		setHeaders(w)
+		handleError(w, err)
+		return
+	}
+	st := user.OAuthState{
+		State:    req.State,
+		Provider: p.Name(),
+		Nonce:    req.Nonce,
+		Verifier: req.Verifier,
+		UserID:   userID,
+	}
+	if err := a.userService.SaveOAuthState(st); err != nil {
+		setHeaders(w)
+		handleError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (a *App) oauthCallback(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		handleError(w, common.InvalidArgumentError(nil, "identity provider rejected the login: "+e))
+		return
+	}
+
+	st, err := a.userService.TakeOAuthState(q.Get("state"))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	p, ok := a.providers[st.Provider]
+	if !ok {
+		handleError(w, common.NotFoundError(nil, "unknown identity provider"))
+		return
+	}
+
+	claims, err := p.Exchange(q.Get("code"), oidc.AuthRequest{State: st.State, Nonce: st.Nonce, Verifier: st.Verifier})
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	ext := user.ExternalIdentity{
+		Provider:      p.Name(),
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Login:         claims.PreferredUsername,
+		FirstName:     claims.GivenName,
+		LastName:      claims.FamilyName,
+	}
+
+	if st.UserID != "" {
+		if err := a.userService.LinkExternal(st.UserID, ext); err != nil {
+			handleError(w, err)
+			return
+		}
+		common.InfoLogger.Printf("%s identity linked to user %s", p.Name(), st.UserID)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	res, err := a.userService.LoginExternal(ext)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if res.Challenge != "" {
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			handleError(w, err)
+		}
+		return
+	}
+	setSessionCookie(w, res)
+	a.audit(r, audit.Event{Type: audit.Login, ActorID: res.UserID, TargetID: res.UserID, Details: p.Name()})
+	common.InfoLogger.Printf("User logged in through %s", p.Name())
+	if !res.TwoFactorSetup {
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
+
+func (a *App) oauthUnlink(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		Provider string `json:"provider"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	if err := a.userService.UnlinkExternal(u.userID, req.Provider); err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("%s unlinked %s identity", u.login, req.Provider)
+}
+
+func (a *App) oauthIdentities(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	u, _ := r.Context().Value("user").(userContext)
+	identities, err := a.userService.LinkedIdentities(u.userID)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(identities); err != nil {
+		handleError(w, err)
+		return
+	}
+}
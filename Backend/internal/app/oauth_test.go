@@ -0,0 +1,253 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"forum/internal/audit"
+	"forum/internal/oidc"
+	"forum/internal/oidc/oidctest"
+	"forum/internal/user"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestApp opens an App on a fresh database, with the handlers of the
+// external login wired to an in-process provider named "test".
+func newTestApp(t *testing.T) (*App, *oidctest.Server) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "forum.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	schema, err := ioutil.ReadFile("../../createTables.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := oidctest.NewServer("forum")
+	t.Cleanup(srv.Close)
+	srv.SignIn(oidctest.Identity{Subject: "sub-1", Email: "ann@example.com", EmailVerified: true})
+
+	a := &App{
+		db:          db,
+		auditLog:    audit.NewService(db),
+		userService: user.NewService(db),
+		providers: map[string]*oidc.Provider{"test": oidc.NewProvider(oidc.ProviderConfig{
+			Name:        "test",
+			Issuer:      srv.Issuer,
+			ClientID:    "forum",
+			RedirectURL: "http://forum.test/oauth/callback",
+		})},
+	}
+	return a, srv
+}
+
+// startLogin runs the login or link handler as the user, if any, and lets the
+// provider sign in. It returns the callback URL the provider redirected to.
+func startLogin(t *testing.T, a *App, userID string) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	if userID == "" {
+		a.oauthLogin(rec, httptest.NewRequest(http.MethodGet, "/oauth/login?provider=test", nil))
+	} else {
+		r := httptest.NewRequest(http.MethodGet, "/oauth/link?provider=test", nil)
+		a.oauthLink(rec, r.WithContext(context.WithValue(r.Context(), "user", userContext{userID: userID})))
+	}
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login: got status %d: %s", rec.Code, rec.Body)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: got status %d", resp.StatusCode)
+	}
+	return resp.Header.Get("Location")
+}
+
+func callback(a *App, callbackURL string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	a.oauthCallback(rec, httptest.NewRequest(http.MethodGet, callbackURL, nil))
+	return rec
+}
+
+// sessionUser returns the user of the session cookie set by the response.
+func sessionUser(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "session" {
+			if i := strings.LastIndex(c.Value, "|"); i >= 0 {
+				return c.Value[i+1:]
+			}
+		}
+	}
+	t.Fatalf("no session cookie, status %d: %s", rec.Code, rec.Body)
+	return ""
+}
+
+func registerLocal(t *testing.T, a *App, login, email string) user.User {
+	t.Helper()
+	u, err := a.userService.Register(user.User{
+		Login:     login,
+		Email:     email,
+		Password:  "Tr0ub4dor&3x",
+		RepeatPWD: "Tr0ub4dor&3x",
+		Age:       30,
+		FirstName: "Ann",
+		LastName:  "Lee",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestOAuthLoginRegistersUser(t *testing.T) {
+	a, _ := newTestApp(t)
+
+	rec := callback(a, startLogin(t, a, ""))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("callback: got status %d: %s", rec.Code, rec.Body)
+	}
+	u, err := a.userService.FindByCredential("ann@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sessionUser(t, rec); got != u.ID {
+		t.Fatalf("session of %s, want %s", got, u.ID)
+	}
+
+	// the next login finds the account through the identity
+	rec = callback(a, startLogin(t, a, ""))
+	if got := sessionUser(t, rec); got != u.ID {
+		t.Fatalf("second login: session of %s, want %s", got, u.ID)
+	}
+}
+
+func TestOAuthCallbackRejectsReplay(t *testing.T) {
+	a, _ := newTestApp(t)
+	callbackURL := startLogin(t, a, "")
+	if rec := callback(a, callbackURL); rec.Code != http.StatusFound {
+		t.Fatalf("callback: got status %d: %s", rec.Code, rec.Body)
+	}
+
+	// the state, with its nonce and verifier, is used up by the first callback
+	rec := callback(a, callbackURL)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("replayed callback: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if len(rec.Result().Cookies()) != 0 {
+		t.Fatal("replayed callback set a cookie")
+	}
+}
+
+func TestOAuthCallbackChecksState(t *testing.T) {
+	a, _ := newTestApp(t)
+	u, err := url.Parse(startLogin(t, a, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("state", "forged")
+	u.RawQuery = q.Encode()
+
+	rec := callback(a, u.String())
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOAuthCallbackRejectsForgedToken(t *testing.T) {
+	a, srv := newTestApp(t)
+	srv.Forge(true)
+
+	rec := callback(a, startLogin(t, a, ""))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if _, err := a.userService.FindByCredential("ann@example.com"); err == nil {
+		t.Fatal("an account was created for a forged token")
+	}
+}
+
+func TestOAuthLoginDoesNotLinkByEmail(t *testing.T) {
+	a, _ := newTestApp(t)
+	local := registerLocal(t, a, "ann", "ann@example.com")
+	if _, err := a.userService.SetRole(local.ID, user.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := callback(a, startLogin(t, a, ""))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusConflict, rec.Body)
+	}
+	if len(rec.Result().Cookies()) != 0 {
+		t.Fatal("login with the email of another account set a cookie")
+	}
+	ids, err := a.userService.LinkedIdentities(local.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("identity was linked by email: %+v", ids)
+	}
+}
+
+func TestOAuthLoginRequiresVerifiedEmail(t *testing.T) {
+	a, srv := newTestApp(t)
+	srv.SignIn(oidctest.Identity{Subject: "sub-2", Email: "bob@example.com"})
+
+	rec := callback(a, startLogin(t, a, ""))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body)
+	}
+	if _, err := a.userService.FindByCredential("bob@example.com"); err == nil {
+		t.Fatal("an account was registered with an unverified email")
+	}
+
+	// the owner of the address can still register it
+	registerLocal(t, a, "bob", "bob@example.com")
+}
+
+func TestOAuthLink(t *testing.T) {
+	a, _ := newTestApp(t)
+	local := registerLocal(t, a, "ann", "ann@example.com")
+
+	rec := callback(a, startLogin(t, a, local.ID))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("link: got status %d: %s", rec.Code, rec.Body)
+	}
+	ids, err := a.userService.LinkedIdentities(local.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0].Provider != "test" {
+		t.Fatalf("linked identities %+v, want the test one", ids)
+	}
+
+	// the identity now signs in the account which linked it
+	rec = callback(a, startLogin(t, a, ""))
+	if got := sessionUser(t, rec); got != local.ID {
+		t.Fatalf("session of %s, want %s", got, local.ID)
+	}
+
+	// and cannot be linked to another one
+	other := registerLocal(t, a, "bob", "bob@example.com")
+	rec = callback(a, startLogin(t, a, other.ID))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("link to a second account: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,183 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"forum/internal/audit"
+	"forum/internal/common"
+	"forum/internal/user"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//Profile handlers
+
+func (a *App) updateProfile(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var upd user.ProfileUpdate
+	if err := json.NewDecoder(r.Body).Decode(&upd); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	updated, err := a.userService.UpdateProfile(u.userID, upd)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("%s updated profile", u.login)
+	if err := json.NewEncoder(w).Encode(updated); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) changeLogin(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	if err := a.userService.ChangeLogin(u.userID, req.Login); err != nil {
+		handleError(w, err)
+		return
+	}
+	a.audit(r, audit.Event{Type: audit.LoginChanged, TargetID: u.userID, Details: fmt.Sprintf("%s -> %s", u.login, req.Login)})
+	common.InfoLogger.Printf("%s changed login to %s", u.login, req.Login)
+	a.ws.Reconnect(u.login)
+	a.ws.SendListUsers()
+}
+
+func (a *App) changePassword(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		Password        string `json:"password"`
+		RepeatPWD       string `json:"repeat_pwd"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	if err := a.userService.ChangePassword(u.userID, req.CurrentPassword, req.Password, req.RepeatPWD); err != nil {
+		handleError(w, err)
+		return
+	}
+	a.audit(r, audit.Event{Type: audit.PasswordChanged, TargetID: u.userID})
+	common.InfoLogger.Printf("%s changed password", u.login)
+}
+
+func (a *App) changeEmail(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	if err := a.userService.RequestEmailChange(u.userID, req.Password, req.Email); err != nil {
+		handleError(w, err)
+		return
+	}
+	a.audit(r, audit.Event{Type: audit.EmailChangeRequest, TargetID: u.userID, Details: "to " + req.Email})
+	common.InfoLogger.Printf("%s requested email change", u.login)
+}
+
+func (a *App) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	userID, err := a.userService.VerifyEmailChange(r.URL.Query().Get("token"))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	a.audit(r, audit.Event{Type: audit.EmailChanged, TargetID: userID})
+	common.InfoLogger.Println("Email change verified")
+}
+
+func (a *App) uploadAvatar(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	u, _ := r.Context().Value("user").(userContext)
+	if r.Method == http.MethodDelete {
+		if err := a.userService.DeleteAvatar(u.userID); err != nil {
+			handleError(w, err)
+		}
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, user.MaxAvatarBytes+1<<20)
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		handleError(w, common.InvalidArgumentError(err, "avatar file is missing"))
+		return
+	}
+	defer file.Close()
+
+	if err := a.userService.SetAvatar(u.userID, file); err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("%s uploaded avatar", u.login)
+
+	res := struct {
+		Avatar string `json:"avatar"`
+	}{user.AvatarURL(u.userID)}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) avatar(w http.ResponseWriter, r *http.Request) {
+	data, updatedAt, err := a.userService.Avatar(r.URL.Query().Get("id"))
+	if err != nil {
+		setHeaders(w)
+		handleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(updatedAt.UnixNano(), 36)))
+	http.ServeContent(w, r, "avatar.png", time.Time{}, bytes.NewReader(data))
+}
+
+func (a *App) setPresence(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		State        user.PresenceState `json:"state"`
+		CustomStatus string             `json:"custom_status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	if err := a.userService.SetPresence(u.userID, req.State, req.CustomStatus); err != nil {
+		handleError(w, err)
+		return
+	}
+	a.ws.PushPresence(u.userID)
+	common.InfoLogger.Printf("%s set presence to %s", u.login, req.State)
+}
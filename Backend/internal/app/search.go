@@ -0,0 +1,66 @@
+package app
+
+import (
+	"encoding/json"
+	"forum/internal/chat"
+	"forum/internal/common"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//Search handlers
+
+func (a *App) searchMessages(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	q := r.URL.Query()
+	sq := chat.SearchQuery{Text: q.Get("q"), With: q.Get("with"), Context: chat.DefaultSearchContext}
+	for _, t := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &sq.From}, {"to", &sq.To}} {
+		if v := q.Get(t.name); v != "" {
+			parsed, err := parseTimeOrDate(v)
+			if err != nil {
+				handleError(w, common.InvalidArgumentError(err, t.name+" must be a date or an RFC 3339 time"))
+				return
+			}
+			*t.dst = parsed
+		}
+	}
+	if v := q.Get("context"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			handleError(w, common.InvalidArgumentError(err, "context must be a number"))
+			return
+		}
+		sq.Context = n
+	}
+	var err error
+	if sq.Page, sq.Limit, err = pageParams(r); err != nil {
+		handleError(w, err)
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	res, err := a.chatService.Search(u.userID, sq)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("%s searched messages, %d hits", u.login, len(res.Hits))
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+// parseTimeOrDate accepts an RFC 3339 time or a plain date, which means the
+// start of that day in UTC.
+func parseTimeOrDate(v string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"forum/internal/audit"
+	"forum/internal/common"
+	"forum/internal/user"
+	"net/http"
+)
+
+//Personal access token handlers
+
+func (a *App) createToken(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		Name          string       `json:"name"`
+		Scopes        []user.Scope `json:"scopes"`
+		ExpiresInDays int          `json:"expires_in_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	t, err := a.userService.CreateToken(u.userID, req.Name, req.Scopes, req.ExpiresInDays)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("%s created token %q", u.login, t.Name)
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) listTokens(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	u, _ := r.Context().Value("user").(userContext)
+	tokens, err := a.userService.ListTokens(u.userID)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(tokens); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) revokeToken(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	if err := a.userService.RevokeToken(u.userID, req.ID); err != nil {
+		handleError(w, err)
+		return
+	}
+	a.audit(r, audit.Event{Type: audit.TokenRevoked, TargetID: u.userID, Details: fmt.Sprintf("token %d", req.ID)})
+	common.InfoLogger.Printf("%s revoked token %d", u.login, req.ID)
+}
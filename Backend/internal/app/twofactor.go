@@ -0,0 +1,123 @@
+package app
+
+import (
+	"encoding/json"
+	"forum/internal/audit"
+	"forum/internal/common"
+	"net/http"
+)
+
+//Two-factor handlers
+
+func (a *App) logInTwoFactor(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		Challenge    string `json:"challenge"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+
+	res, err := a.userService.VerifyChallenge(req.Challenge, req.Code, req.RecoveryCode, client(r))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	setSessionCookie(w, res)
+	a.audit(r, audit.Event{Type: audit.Login, ActorID: res.UserID, TargetID: res.UserID, Details: "two-factor"})
+	common.InfoLogger.Println("Two-factor login completed")
+}
+
+func (a *App) enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	u, _ := r.Context().Value("user").(userContext)
+	enrollment, err := a.userService.EnrollTwoFactor(u.userID)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	common.InfoLogger.Printf("%s started two-factor enrollment", u.login)
+	if err := json.NewEncoder(w).Encode(enrollment); err != nil {
+		handleError(w, err)
+		return
+	}
+}
+
+func (a *App) confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	codes, err := a.userService.ConfirmTwoFactor(u.userID, req.Code)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	a.audit(r, audit.Event{Type: audit.TwoFactorEnabled, TargetID: u.userID})
+	common.InfoLogger.Printf("%s enabled two-factor authentication", u.login)
+	writeRecoveryCodes(w, codes)
+}
+
+func (a *App) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	if err := a.userService.DisableTwoFactor(u.userID, req.Password, req.Code); err != nil {
+		handleError(w, err)
+		return
+	}
+	a.audit(r, audit.Event{Type: audit.TwoFactorDisabled, TargetID: u.userID})
+	common.InfoLogger.Printf("%s disabled two-factor authentication", u.login)
+}
+
+func (a *App) regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, common.InvalidArgumentError(err, "invalid json"))
+		return
+	}
+	u, _ := r.Context().Value("user").(userContext)
+
+	codes, err := a.userService.RegenerateRecoveryCodes(u.userID, req.Code)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	a.audit(r, audit.Event{Type: audit.RecoveryCodesReset, TargetID: u.userID})
+	common.InfoLogger.Printf("%s regenerated recovery codes", u.login)
+	writeRecoveryCodes(w, codes)
+}
+
+func writeRecoveryCodes(w http.ResponseWriter, codes []string) {
+	res := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{codes}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		handleError(w, err)
+	}
+}
@@ -0,0 +1,69 @@
+package audit
+
+import (
+	"database/sql"
+	"forum/internal/common"
+	"time"
+)
+
+// Types of events recorded by the application itself. Events coming from the
+// user service keep their own type names.
+const (
+	Login              = "login"
+	Logout             = "logout"
+	SessionsRevoked    = "sessions_revoked"
+	TokenRevoked       = "token_revoked"
+	PasswordChanged    = "password_changed"
+	RoleChanged        = "role_changed"
+	TwoFactorPolicySet = "two_factor_policy_changed"
+	TwoFactorEnabled   = "two_factor_enabled"
+	TwoFactorDisabled  = "two_factor_disabled"
+	RecoveryCodesReset = "recovery_codes_regenerated"
+	EmailChangeRequest = "email_change_requested"
+	EmailChanged       = "email_changed"
+	LoginChanged       = "login_changed"
+	DeletionRequested  = "account_deletion_requested"
+	DeletionCancelled  = "account_deletion_cancelled"
+)
+
+// Event is one entry of the audit log. ActorID is the user who did it and
+// TargetID the account it was done to; either may be empty.
+type Event struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	ActorID   string    `json:"actor_id,omitempty"`
+	TargetID  string    `json:"target_id,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Details   string    `json:"details,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Service stores audit events. The table is append-only, events are never
+// updated or deleted.
+type Service struct {
+	db *sql.DB
+}
+
+func NewService(db *sql.DB) *Service {
+	return &Service{db: db}
+}
+
+func (s *Service) Record(e Event) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	_, err := s.db.Exec(`INSERT INTO audit_events (event_type, actor_id, target_id, ip, user_agent, details, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		e.Type, nullable(e.ActorID), nullable(e.TargetID), e.IP, e.UserAgent, e.Details, e.CreatedAt)
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	return nil
+}
+
+func nullable(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,131 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"forum/internal/common"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// Filter selects audit events. Zero fields match everything; UserID matches
+// events where the user is either the actor or the target.
+type Filter struct {
+	Type   string
+	UserID string
+	IP     string
+	From   time.Time
+	To     time.Time
+	Page   int
+	Limit  int
+}
+
+type Page struct {
+	Events  []Event `json:"events"`
+	Page    int     `json:"page"`
+	HasMore bool    `json:"has_more"`
+}
+
+func (f Filter) where() (string, []interface{}) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if f.Type != "" {
+		add("event_type=$%d", f.Type)
+	}
+	if f.UserID != "" {
+		args = append(args, f.UserID)
+		conds = append(conds, fmt.Sprintf("(actor_id=$%[1]d OR target_id=$%[1]d)", len(args)))
+	}
+	if f.IP != "" {
+		add("ip=$%d", f.IP)
+	}
+	if !f.From.IsZero() {
+		add("created_at>=$%d", f.From)
+	}
+	if !f.To.IsZero() {
+		add("created_at<$%d", f.To)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// Find returns one page of matching events, newest first.
+func (s *Service) Find(f Filter) (Page, error) {
+	if f.Limit <= 0 {
+		f.Limit = defaultPageSize
+	}
+	if f.Limit > maxPageSize {
+		return Page{}, common.InvalidArgumentError(nil, fmt.Sprintf("limit must not exceed %d", maxPageSize))
+	}
+	if f.Page < 1 {
+		f.Page = 1
+	}
+
+	where, args := f.where()
+	query := fmt.Sprintf(`SELECT id, event_type, coalesce(actor_id, ''), coalesce(target_id, ''), ip, user_agent, details, created_at
+		FROM audit_events%s ORDER BY id DESC LIMIT %d OFFSET %d`, where, f.Limit+1, (f.Page-1)*f.Limit)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return Page{}, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	page := Page{Events: make([]Event, 0, f.Limit), Page: f.Page}
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.ID, &e.Type, &e.ActorID, &e.TargetID, &e.IP, &e.UserAgent, &e.Details, &e.CreatedAt); err != nil {
+			return Page{}, common.DataBaseError(err)
+		}
+		if len(page.Events) == f.Limit {
+			page.HasMore = true
+			break
+		}
+		page.Events = append(page.Events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return Page{}, common.DataBaseError(err)
+	}
+	return page, nil
+}
+
+// Export writes every matching event as one JSON object per line, oldest
+// first. Paging fields of the filter are ignored.
+func (s *Service) Export(f Filter, w io.Writer) error {
+	where, args := f.where()
+	query := fmt.Sprintf(`SELECT id, event_type, coalesce(actor_id, ''), coalesce(target_id, ''), ip, user_agent, details, created_at
+		FROM audit_events%s ORDER BY id`, where)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	enc := json.NewEncoder(w)
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.ID, &e.Type, &e.ActorID, &e.TargetID, &e.IP, &e.UserAgent, &e.Details, &e.CreatedAt); err != nil {
+			return common.DataBaseError(err)
+		}
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return common.DataBaseError(err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// Package broker passes realtime events between forum instances. A single
+// instance uses the in-process Local broker; replicas behind a load balancer
+// share a Redis server, or anything speaking its pub/sub protocol.
+package broker
+
+import (
+	"strings"
+	"sync"
+)
+
+// Handler receives the payload of a published message. Handlers of one
+// channel are called one at a time, in publishing order.
+type Handler func(data []byte)
+
+type Broker interface {
+	// Publish sends the data to every subscriber of the channel on every
+	// instance, this one included.
+	Publish(channel string, data []byte) error
+	Subscribe(channel string, h Handler) error
+	Close() error
+}
+
+// New returns a Local broker for an empty address and a Redis client
+// otherwise. The address is host:port, optionally prefixed with redis://.
+func New(addr string) (Broker, error) {
+	if addr == "" {
+		return NewLocal(), nil
+	}
+	return DialRedis(strings.TrimPrefix(addr, "redis://"))
+}
+
+// Local delivers messages within the process, synchronously.
+type Local struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+func NewLocal() *Local {
+	return &Local{handlers: make(map[string][]Handler)}
+}
+
+func (l *Local) Publish(channel string, data []byte) error {
+	l.mu.RLock()
+	handlers := l.handlers[channel]
+	l.mu.RUnlock()
+	for _, h := range handlers {
+		h(data)
+	}
+	return nil
+}
+
+func (l *Local) Subscribe(channel string, h Handler) error {
+	l.mu.Lock()
+	l.handlers[channel] = append(l.handlers[channel], h)
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *Local) Close() error {
+	return nil
+}
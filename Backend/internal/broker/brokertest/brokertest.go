@@ -0,0 +1,199 @@
+// Package brokertest implements a minimal stand-in for Redis pub/sub, for the
+// tests of the Redis broker and for running several forum instances locally
+// without a Redis server. It understands PUBLISH, SUBSCRIBE, UNSUBSCRIBE,
+// PING and QUIT.
+package brokertest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"forum/internal/broker"
+	"forum/internal/common"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+type client struct {
+	conn     net.Conn
+	mu       sync.Mutex
+	channels map[string]bool
+}
+
+func (c *client) write(s string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, _ = io.WriteString(c.conn, s)
+}
+
+// Server relays the published messages to the subscribed connections.
+type Server struct {
+	mu      sync.RWMutex
+	subs    map[string]map[*client]bool
+	clients map[*client]bool
+	ln      net.Listener
+}
+
+// NewServer creates a server; Serve or Listen starts it.
+func NewServer() *Server {
+	return &Server{subs: make(map[string]map[*client]bool), clients: make(map[*client]bool)}
+}
+
+// Listen starts a server on the address in the background.
+func Listen(addr string) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := NewServer()
+	s.ln = ln
+	go s.Serve(ln)
+	return s, nil
+}
+
+// Serve accepts connections until the listener is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			common.ErrorLogger.Println(err)
+			continue
+		}
+		c := &client{conn: conn, channels: make(map[string]bool)}
+		s.mu.Lock()
+		s.clients[c] = true
+		s.mu.Unlock()
+		go s.serve(c)
+	}
+}
+
+// Addr is the address the server listens on.
+func (s *Server) Addr() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ln.Addr().String()
+}
+
+// Disconnect drops every connection, as a restarting server would.
+func (s *Server) Disconnect() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+}
+
+// Close stops listening and drops every connection.
+func (s *Server) Close() error {
+	s.mu.RLock()
+	ln := s.ln
+	s.mu.RUnlock()
+	var err error
+	if ln != nil {
+		err = ln.Close()
+	}
+	s.Disconnect()
+	return err
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (s *Server) serve(c *client) {
+	defer func() {
+		s.mu.Lock()
+		for ch := range c.channels {
+			delete(s.subs[ch], c)
+		}
+		delete(s.clients, c)
+		s.mu.Unlock()
+		c.conn.Close()
+	}()
+
+	r := bufio.NewReader(c.conn)
+	for {
+		v, err := broker.ReadValue(r)
+		if err != nil {
+			return
+		}
+		xs, ok := v.([]interface{})
+		if !ok || len(xs) == 0 {
+			c.write("-ERR expected a command array\r\n")
+			continue
+		}
+		args := make([]string, len(xs))
+		for i, x := range xs {
+			b, _ := x.([]byte)
+			args[i] = string(b)
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			if len(c.channels) > 0 {
+				c.write("*2\r\n" + bulk("pong") + bulk(""))
+			} else {
+				c.write("+PONG\r\n")
+			}
+		case "QUIT":
+			c.write("+OK\r\n")
+			return
+		case "PUBLISH":
+			if len(args) != 3 {
+				c.write("-ERR wrong number of arguments for 'publish' command\r\n")
+				continue
+			}
+			c.write(fmt.Sprintf(":%d\r\n", s.publish(args[1], args[2])))
+		case "SUBSCRIBE":
+			for _, ch := range args[1:] {
+				s.mu.Lock()
+				if s.subs[ch] == nil {
+					s.subs[ch] = make(map[*client]bool)
+				}
+				s.subs[ch][c] = true
+				s.mu.Unlock()
+				c.channels[ch] = true
+				c.write("*3\r\n" + bulk("subscribe") + bulk(ch) + fmt.Sprintf(":%d\r\n", len(c.channels)))
+			}
+		case "UNSUBSCRIBE":
+			channels := args[1:]
+			if len(channels) == 0 {
+				for ch := range c.channels {
+					channels = append(channels, ch)
+				}
+			}
+			for _, ch := range channels {
+				s.mu.Lock()
+				delete(s.subs[ch], c)
+				s.mu.Unlock()
+				delete(c.channels, ch)
+				c.write("*3\r\n" + bulk("unsubscribe") + bulk(ch) + fmt.Sprintf(":%d\r\n", len(c.channels)))
+			}
+		default:
+			c.write(fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0]))
+		}
+	}
+}
+
+// publish sends the message to the subscribers and returns their number.
+func (s *Server) publish(channel, msg string) int {
+	frame := "*3\r\n" + bulk("message") + bulk(channel) + bulk(msg)
+	s.mu.RLock()
+	subs := make([]*client, 0, len(s.subs[channel]))
+	for c := range s.subs[channel] {
+		subs = append(subs, c)
+	}
+	s.mu.RUnlock()
+	for _, c := range subs {
+		c.write(frame)
+	}
+	return len(subs)
+}
@@ -0,0 +1,208 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"forum/internal/common"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout  = 5 * time.Second
+	ioTimeout    = 5 * time.Second
+	pingInterval = 30 * time.Second
+	retryDelay   = time.Second
+)
+
+// Redis publishes and subscribes through a Redis server, using one connection
+// for publishing and one for the subscriptions. A lost subscription
+// connection is re-established in the background; messages published
+// meanwhile are not delivered to this instance, as usual with Redis pub/sub.
+type Redis struct {
+	addr string
+
+	pubMu sync.Mutex
+	pub   net.Conn
+	pubR  *bufio.Reader
+
+	mu       sync.Mutex
+	handlers map[string][]Handler
+	sub      net.Conn
+	// subW serialises writes to the subscription connection.
+	subW sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// DialRedis connects to the server at addr, failing if it is unreachable.
+func DialRedis(addr string) (*Redis, error) {
+	r := &Redis{addr: addr, handlers: make(map[string][]Handler), done: make(chan struct{})}
+	if err := r.connectPub(); err != nil {
+		return nil, err
+	}
+	go r.subscribeLoop()
+	return r, nil
+}
+
+func (r *Redis) connectPub() error {
+	conn, err := net.DialTimeout("tcp", r.addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	r.pub, r.pubR = conn, bufio.NewReader(conn)
+	return nil
+}
+
+// Publish sends the message, reconnecting once if the connection broke.
+func (r *Redis) Publish(channel string, data []byte) error {
+	r.pubMu.Lock()
+	defer r.pubMu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if r.pub == nil {
+			if err = r.connectPub(); err != nil {
+				return err
+			}
+		}
+		_ = r.pub.SetDeadline(time.Now().Add(ioTimeout))
+		if err = WriteCommand(r.pub, "PUBLISH", channel, string(data)); err == nil {
+			_, err = ReadValue(r.pubR)
+		}
+		var respErr *RESPError
+		if err == nil || errors.As(err, &respErr) {
+			return err
+		}
+		_ = r.pub.Close()
+		r.pub = nil
+	}
+	return err
+}
+
+func (r *Redis) Subscribe(channel string, h Handler) error {
+	r.mu.Lock()
+	first := len(r.handlers[channel]) == 0
+	r.handlers[channel] = append(r.handlers[channel], h)
+	sub := r.sub
+	r.mu.Unlock()
+
+	// Without a connection the channel is subscribed on the next connect.
+	if first && sub != nil {
+		return r.writeSub(sub, "SUBSCRIBE", channel)
+	}
+	return nil
+}
+
+func (r *Redis) writeSub(conn net.Conn, args ...string) error {
+	r.subW.Lock()
+	defer r.subW.Unlock()
+	_ = conn.SetWriteDeadline(time.Now().Add(ioTimeout))
+	return WriteCommand(conn, args...)
+}
+
+func (r *Redis) subscribeLoop() {
+	for {
+		conn, err := net.DialTimeout("tcp", r.addr, dialTimeout)
+		if err == nil {
+			err = r.listen(conn)
+		}
+		select {
+		case <-r.done:
+			return
+		default:
+		}
+		common.WarningLogger.Println("broker: subscription connection lost, reconnecting:", err)
+		select {
+		case <-r.done:
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// listen subscribes to every channel with handlers and dispatches messages
+// until the connection fails.
+func (r *Redis) listen(conn net.Conn) error {
+	defer conn.Close()
+
+	r.mu.Lock()
+	r.sub = conn
+	channels := make([]string, 0, len(r.handlers))
+	for ch := range r.handlers {
+		channels = append(channels, ch)
+	}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.sub = nil
+		r.mu.Unlock()
+	}()
+
+	if len(channels) > 0 {
+		if err := r.writeSub(conn, append([]string{"SUBSCRIBE"}, channels...)...); err != nil {
+			return err
+		}
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := r.writeSub(conn, "PING"); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	br := bufio.NewReader(conn)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+		v, err := ReadValue(br)
+		if err != nil {
+			return err
+		}
+		xs, ok := v.([]interface{})
+		if !ok || len(xs) != 3 {
+			continue
+		}
+		kind, _ := xs[0].([]byte)
+		channel, _ := xs[1].([]byte)
+		data, _ := xs[2].([]byte)
+		if string(kind) != "message" {
+			continue
+		}
+		r.mu.Lock()
+		handlers := r.handlers[string(channel)]
+		r.mu.Unlock()
+		for _, h := range handlers {
+			h(data)
+		}
+	}
+}
+
+func (r *Redis) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.pubMu.Lock()
+		if r.pub != nil {
+			_ = r.pub.Close()
+		}
+		r.pubMu.Unlock()
+		r.mu.Lock()
+		if r.sub != nil {
+			_ = r.sub.Close()
+		}
+		r.mu.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,177 @@
+package broker_test
+
+import (
+	"bufio"
+	"bytes"
+	"forum/internal/broker"
+	"forum/internal/broker/brokertest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testChannel = "forum.test"
+
+func startServer(t *testing.T) *brokertest.Server {
+	t.Helper()
+	srv, err := brokertest.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// dial connects a broker to the server and subscribes it to the test channel.
+func dial(t *testing.T, srv *brokertest.Server) (*broker.Redis, chan string) {
+	t.Helper()
+	r, err := broker.DialRedis(srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	got := make(chan string, 64)
+	if err := r.Subscribe(testChannel, func(data []byte) { got <- string(data) }); err != nil {
+		t.Fatal(err)
+	}
+	return r, got
+}
+
+// expect publishes the message until every channel has received it, as the
+// subscriptions are made in the background.
+func expect(t *testing.T, from *broker.Redis, msg string, to ...chan string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, got := range to {
+		for received := false; !received; {
+			if time.Now().After(deadline) {
+				t.Fatalf("%q was not delivered", msg)
+			}
+			if err := from.Publish(testChannel, []byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case m := <-got:
+				received = m == msg
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}
+	// the retries may have been delivered as well
+	time.Sleep(50 * time.Millisecond)
+	for _, got := range to {
+		for len(got) > 0 {
+			<-got
+		}
+	}
+}
+
+func TestRedisPublishSubscribe(t *testing.T) {
+	srv := startServer(t)
+	a, gotA := dial(t, srv)
+	b, gotB := dial(t, srv)
+
+	// every instance receives what any of them publishes, its own messages
+	// included
+	expect(t, a, "from a", gotA, gotB)
+	expect(t, b, "from b", gotA, gotB)
+
+	if err := a.Publish(testChannel, []byte("once")); err != nil {
+		t.Fatal(err)
+	}
+	for _, got := range []chan string{gotA, gotB} {
+		select {
+		case m := <-got:
+			if m != "once" {
+				t.Fatalf("got %q, want %q", m, "once")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message was not delivered")
+		}
+	}
+}
+
+func TestRedisResubscribes(t *testing.T) {
+	srv := startServer(t)
+	a, gotA := dial(t, srv)
+	b, gotB := dial(t, srv)
+	expect(t, a, "before", gotA, gotB)
+
+	// both the publishing and the subscription connections are dropped
+	srv.Disconnect()
+
+	expect(t, a, "after from a", gotA, gotB)
+	expect(t, b, "after from b", gotA, gotB)
+}
+
+func TestRESPRoundTrip(t *testing.T) {
+	tests := [][]string{
+		{"PING"},
+		{"PUBLISH", "forum.chat.events", `{"kind":"send"}`},
+		{"SUBSCRIBE", "a", "b", "c"},
+		{"PUBLISH", "", ""},
+		{"PUBLISH", "lines", "one\r\ntwo\r\n"},
+		{"PUBLISH", "utf-8", "привет, 世界"},
+		{"PUBLISH", "large", strings.Repeat("x", 64<<10)},
+	}
+	for _, args := range tests {
+		var buf bytes.Buffer
+		if err := broker.WriteCommand(&buf, args...); err != nil {
+			t.Fatal(err)
+		}
+		v, err := broker.ReadValue(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatalf("%q: %v", args[0], err)
+		}
+		xs, ok := v.([]interface{})
+		if !ok || len(xs) != len(args) {
+			t.Fatalf("%q: got %#v", args[0], v)
+		}
+		for i, x := range xs {
+			if b, ok := x.([]byte); !ok || string(b) != args[i] {
+				t.Fatalf("%q: argument %d is %#v, want %q", args[0], i, x, args[i])
+			}
+		}
+	}
+}
+
+func TestRESPReadValue(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+	}{
+		{"+OK\r\n", "OK"},
+		{":42\r\n", int64(42)},
+		{":-1\r\n", int64(-1)},
+		{"$5\r\nhello\r\n", []byte("hello")},
+		{"$0\r\n\r\n", []byte{}},
+		{"$-1\r\n", []byte(nil)},
+		{"*-1\r\n", []interface{}(nil)},
+		{"*0\r\n", []interface{}{}},
+		{
+			"*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n*2\r\n:1\r\n+x\r\n",
+			[]interface{}{[]byte("message"), []byte("ch"), []interface{}{int64(1), "x"}},
+		},
+	}
+	for _, tt := range tests {
+		got, err := broker.ReadValue(bufio.NewReader(strings.NewReader(tt.in)))
+		if err != nil {
+			t.Fatalf("%q: %v", tt.in, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%q: got %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+
+	v, err := broker.ReadValue(bufio.NewReader(strings.NewReader("-ERR unknown command\r\n")))
+	if rerr, ok := err.(*broker.RESPError); !ok || rerr.Message != "ERR unknown command" || v != nil {
+		t.Fatalf("got %#v, %v, want a RESPError", v, err)
+	}
+
+	for _, in := range []string{"OK\r\n", "+OK\n", "?1\r\n", ":x\r\n", "$5\r\nhi\r\n", "*2\r\n:1\r\n"} {
+		if _, err := broker.ReadValue(bufio.NewReader(strings.NewReader(in))); err == nil {
+			t.Fatalf("%q: no error", in)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The subset of RESP, the Redis serialization protocol, needed for pub/sub.
+// Values are read as string (simple strings), int64 (integers), []byte (bulk
+// strings, nil when null) and []interface{} (arrays). Error replies are
+// returned as *RESPError.
+
+type RESPError struct {
+	Message string
+}
+
+func (e *RESPError) Error() string {
+	return "redis: " + e.Message
+}
+
+// WriteCommand writes the arguments as an array of bulk strings.
+func WriteCommand(w io.Writer, args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ReadValue reads one value.
+func ReadValue(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, &RESPError{Message: body}
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return []byte(nil), nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return []interface{}(nil), nil
+		}
+		xs := make([]interface{}, n)
+		for i := range xs {
+			if xs[i], err = ReadValue(r); err != nil {
+				return nil, err
+			}
+		}
+		return xs, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
@@ -0,0 +1,327 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"forum/internal/common"
+	"forum/internal/user"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ConversationKind tells groups, which are private and managed by their
+// owner, from rooms, which belong to a forum category and anyone may join.
+type ConversationKind string
+
+const (
+	KindGroup ConversationKind = "group"
+	KindRoom  ConversationKind = "room"
+)
+
+type MemberRole string
+
+const (
+	MemberOwner  MemberRole = "owner"
+	MemberMember MemberRole = "member"
+)
+
+const (
+	maxConversationName = 100
+	maxGroupMembers     = 50
+)
+
+var ErrNotMember = common.NewAppError(nil, "you are not a member of this conversation", http.StatusForbidden)
+
+type Conversation struct {
+	ID         int              `json:"id"`
+	Kind       ConversationKind `json:"kind"`
+	Name       string           `json:"name"`
+	CategoryID int              `json:"category_id,omitempty"`
+	CreatedAt  time.Time        `json:"created_at"`
+	Members    []Member         `json:"members,omitempty"`
+}
+
+type Member struct {
+	UserID   string     `json:"user_id"`
+	Login    string     `json:"login"`
+	Role     MemberRole `json:"role"`
+	JoinedAt time.Time  `json:"joined_at"`
+}
+
+// CreateGroup creates a group owned by the user with the given members.
+func (s *Service) CreateGroup(ownerID, name string, logins []string) (Conversation, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Conversation{}, common.InvalidArgumentError(nil, "conversation name is required")
+	}
+	if utf8.RuneCountInString(name) > maxConversationName {
+		return Conversation{}, common.InvalidArgumentError(nil, "conversation name is too long")
+	}
+	if len(logins)+1 > maxGroupMembers {
+		return Conversation{}, common.InvalidArgumentError(nil, fmt.Sprintf("a group can have at most %d members", maxGroupMembers))
+	}
+	members := make([]user.User, 0, len(logins))
+	for _, login := range logins {
+		u, err := s.userService.FindByCredential(login)
+		if err != nil {
+			return Conversation{}, err
+		}
+		if u.ID != ownerID {
+			members = append(members, u)
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Conversation{}, common.DataBaseError(err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	res, err := tx.Exec(`INSERT INTO conversations (kind, name, created_by, created_at) VALUES ($1, $2, $3, $4)`,
+		KindGroup, name, ownerID, now)
+	if err != nil {
+		return Conversation{}, common.DataBaseError(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Conversation{}, common.DataBaseError(err)
+	}
+	add := `INSERT OR IGNORE INTO conversation_members (conversation_id, user_id, role, joined_at) VALUES ($1, $2, $3, $4)`
+	if _, err := tx.Exec(add, id, ownerID, MemberOwner, now); err != nil {
+		return Conversation{}, common.DataBaseError(err)
+	}
+	for _, u := range members {
+		if _, err := tx.Exec(add, id, u.ID, MemberMember, now); err != nil {
+			return Conversation{}, common.DataBaseError(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return Conversation{}, common.DataBaseError(err)
+	}
+	return s.Conversation(int(id))
+}
+
+// Conversation returns the conversation with its members.
+func (s *Service) Conversation(id int) (Conversation, error) {
+	var (
+		c   Conversation
+		cat sql.NullInt64
+	)
+	row := s.db.QueryRow(`SELECT id, kind, name, category_id, created_at FROM conversations WHERE id=$1`, id)
+	if err := row.Scan(&c.ID, &c.Kind, &c.Name, &cat, &c.CreatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Conversation{}, common.NotFoundError(nil, "conversation not found")
+		}
+		return Conversation{}, common.DataBaseError(err)
+	}
+	c.CategoryID = int(cat.Int64)
+
+	rows, err := s.db.Query(`SELECT m.user_id, u.login, m.role, m.joined_at
+FROM conversation_members m
+         JOIN users u ON u.id = m.user_id
+WHERE m.conversation_id = $1
+ORDER BY m.joined_at, u.login`, id)
+	if err != nil {
+		return Conversation{}, common.DataBaseError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.UserID, &m.Login, &m.Role, &m.JoinedAt); err != nil {
+			return Conversation{}, common.DataBaseError(err)
+		}
+		c.Members = append(c.Members, m)
+	}
+	return c, rows.Err()
+}
+
+// Conversations lists the groups and rooms the user is a member of.
+func (s *Service) Conversations(userID string) ([]Conversation, error) {
+	rows, err := s.db.Query(`SELECT c.id, c.kind, c.name, coalesce(c.category_id, 0), c.created_at
+FROM conversations c
+         JOIN conversation_members m ON m.conversation_id = c.id
+WHERE m.user_id = $1
+ORDER BY c.name COLLATE NOCASE`, userID)
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	convs := []Conversation{}
+	for rows.Next() {
+		var c Conversation
+		if err := rows.Scan(&c.ID, &c.Kind, &c.Name, &c.CategoryID, &c.CreatedAt); err != nil {
+			return nil, common.DataBaseError(err)
+		}
+		convs = append(convs, c)
+	}
+	return convs, rows.Err()
+}
+
+// Rooms lists the public room of every forum category, creating the missing
+// ones.
+func (s *Service) Rooms() ([]Conversation, error) {
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO conversations (kind, name, category_id, created_at)
+SELECT $1, name, id, $2 FROM categories`, KindRoom, time.Now())
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	rows, err := s.db.Query(`SELECT id, kind, name, category_id, created_at FROM conversations WHERE kind=$1 ORDER BY category_id`, KindRoom)
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	rooms := []Conversation{}
+	for rows.Next() {
+		var c Conversation
+		if err := rows.Scan(&c.ID, &c.Kind, &c.Name, &c.CategoryID, &c.CreatedAt); err != nil {
+			return nil, common.DataBaseError(err)
+		}
+		rooms = append(rooms, c)
+	}
+	return rooms, rows.Err()
+}
+
+func (s *Service) memberRole(convID int, userID string) (MemberRole, error) {
+	var role MemberRole
+	err := s.db.QueryRow(`SELECT role FROM conversation_members WHERE conversation_id=$1 AND user_id=$2`, convID, userID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotMember
+	}
+	if err != nil {
+		return "", common.DataBaseError(err)
+	}
+	return role, nil
+}
+
+// JoinRoom adds the user to a public room.
+func (s *Service) JoinRoom(userID string, convID int) (Conversation, error) {
+	c, err := s.Conversation(convID)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if c.Kind != KindRoom {
+		return Conversation{}, common.NewAppError(nil, "groups can only be joined by invitation", http.StatusForbidden)
+	}
+	_, err = s.db.Exec(`INSERT OR IGNORE INTO conversation_members (conversation_id, user_id, role, joined_at) VALUES ($1, $2, $3, $4)`,
+		convID, userID, MemberMember, time.Now())
+	if err != nil {
+		return Conversation{}, common.DataBaseError(err)
+	}
+	return s.Conversation(convID)
+}
+
+// Invite adds the user with the login to a group. Only the owner can invite.
+func (s *Service) Invite(actorID string, convID int, login string) (Conversation, error) {
+	role, err := s.memberRole(convID, actorID)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if role != MemberOwner {
+		return Conversation{}, common.NewAppError(nil, "only the owner can invite to this conversation", http.StatusForbidden)
+	}
+	c, err := s.Conversation(convID)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if len(c.Members) >= maxGroupMembers {
+		return Conversation{}, common.InvalidArgumentError(nil, fmt.Sprintf("a group can have at most %d members", maxGroupMembers))
+	}
+	u, err := s.userService.FindByCredential(login)
+	if err != nil {
+		return Conversation{}, err
+	}
+	_, err = s.db.Exec(`INSERT OR IGNORE INTO conversation_members (conversation_id, user_id, role, joined_at) VALUES ($1, $2, $3, $4)`,
+		convID, u.ID, MemberMember, time.Now())
+	if err != nil {
+		return Conversation{}, common.DataBaseError(err)
+	}
+	return s.Conversation(convID)
+}
+
+// RemoveMember lets the owner remove someone from a group.
+func (s *Service) RemoveMember(actorID string, convID int, login string) (Conversation, error) {
+	role, err := s.memberRole(convID, actorID)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if role != MemberOwner {
+		return Conversation{}, common.NewAppError(nil, "only the owner can remove members", http.StatusForbidden)
+	}
+	u, err := s.userService.FindByCredential(login)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if u.ID == actorID {
+		return Conversation{}, common.InvalidArgumentError(nil, "leave the conversation instead")
+	}
+	if _, err := s.db.Exec(`DELETE FROM conversation_members WHERE conversation_id=$1 AND user_id=$2`, convID, u.ID); err != nil {
+		return Conversation{}, common.DataBaseError(err)
+	}
+	return s.Conversation(convID)
+}
+
+// Leave removes the user from the conversation. When the owner of a group
+// leaves, the longest standing member becomes the owner; an empty group is
+// deleted.
+func (s *Service) Leave(userID string, convID int) (Conversation, error) {
+	role, err := s.memberRole(convID, userID)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if _, err := s.db.Exec(`DELETE FROM conversation_members WHERE conversation_id=$1 AND user_id=$2`, convID, userID); err != nil {
+		return Conversation{}, common.DataBaseError(err)
+	}
+	c, err := s.Conversation(convID)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if c.Kind != KindGroup || role != MemberOwner {
+		return c, nil
+	}
+	if len(c.Members) == 0 {
+		if _, err := s.db.Exec(`DELETE FROM conversations WHERE id=$1`, convID); err != nil {
+			return Conversation{}, common.DataBaseError(err)
+		}
+		return c, nil
+	}
+	next := c.Members[0].UserID
+	if _, err := s.db.Exec(`UPDATE conversation_members SET role=$1 WHERE conversation_id=$2 AND user_id=$3`, MemberOwner, convID, next); err != nil {
+		return Conversation{}, common.DataBaseError(err)
+	}
+	c.Members[0].Role = MemberOwner
+	return c, nil
+}
+
+// SendToConversation stores a message to the conversation and returns it with
+// the logins of the members to deliver it to.
+func (s *Service) SendToConversation(senderID string, convID int, text, clientID string) (Message, []string, error) {
+	if _, err := s.memberRole(convID, senderID); err != nil {
+		return Message{}, nil, err
+	}
+	c, err := s.Conversation(convID)
+	if err != nil {
+		return Message{}, nil, err
+	}
+	from, err := s.userService.FindByCredential(senderID)
+	if err != nil {
+		return Message{}, nil, err
+	}
+
+	m := Message{From: from.Login, ConversationID: convID, Text: text, Avatar: user.AvatarURL(from.ID)}
+	row := s.db.QueryRow(`INSERT INTO chat (msg_from, conversation_id, msg, client_id) VALUES ($1, $2, $3, nullif($4, '')) returning msg_id, send_at`,
+		from.ID, convID, text, clientID)
+	if err := row.Scan(&m.ID, &m.Data); err != nil {
+		return Message{}, nil, common.DataBaseError(err)
+	}
+	logins := make([]string, 0, len(c.Members))
+	for _, member := range c.Members {
+		logins = append(logins, member.Login)
+	}
+	return m, logins, nil
+}
@@ -0,0 +1,108 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"forum/internal/common"
+	"forum/internal/user"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EditWindow is how long after sending a message its author can still edit it.
+// Deleting is always possible.
+var EditWindow = 15 * time.Minute
+
+var errNotAuthor = common.NewAppError(nil, "you can only change your own messages", http.StatusForbidden)
+
+// storedMessage loads a message together with its author's ID.
+func (s *Service) storedMessage(msgID int) (Message, string, error) {
+	var (
+		m      Message
+		fromID string
+		conv   sql.NullInt64
+	)
+	row := s.db.QueryRow(`SELECT c.msg_id, c.msg_from, coalesce(uf.login, ''), coalesce(ut.login, ''), c.conversation_id,
+       c.msg, c.send_at, c.delivered_at, c.read_at, c.edited_at, c.deleted
+FROM chat c
+         LEFT JOIN users uf ON uf.id = c.msg_from
+         LEFT JOIN users ut ON ut.id = c.msg_to
+WHERE c.msg_id = $1`, msgID)
+	err := row.Scan(&m.ID, &fromID, &m.From, &m.To, &conv, &m.Text, &m.Data, &m.DeliveredAt, &m.ReadAt, &m.EditedAt, &m.Deleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Message{}, "", common.NotFoundError(nil, "message not found")
+	}
+	if err != nil {
+		return Message{}, "", common.DataBaseError(err)
+	}
+	m.ConversationID = int(conv.Int64)
+	m.Avatar = user.AvatarURL(fromID)
+	return m, fromID, nil
+}
+
+// recipients returns the logins which see the message: both participants of a
+// private chat or the members of a conversation.
+func (s *Service) recipients(m Message) ([]string, error) {
+	if m.ConversationID == 0 {
+		return []string{m.From, m.To}, nil
+	}
+	c, err := s.Conversation(m.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+	logins := make([]string, 0, len(c.Members))
+	for _, member := range c.Members {
+		logins = append(logins, member.Login)
+	}
+	return logins, nil
+}
+
+// EditMessage replaces the text of a message sent by the user within
+// EditWindow. It returns the updated message and the logins to notify.
+func (s *Service) EditMessage(userID string, msgID int, text string) (Message, []string, error) {
+	if strings.TrimSpace(text) == "" {
+		return Message{}, nil, common.InvalidArgumentError(nil, "message cannot be empty")
+	}
+	m, fromID, err := s.storedMessage(msgID)
+	if err != nil {
+		return Message{}, nil, err
+	}
+	if fromID != userID {
+		return Message{}, nil, errNotAuthor
+	}
+	if m.Deleted {
+		return Message{}, nil, common.InvalidArgumentError(nil, "message was deleted")
+	}
+	if time.Since(m.Data) > EditWindow {
+		return Message{}, nil, common.InvalidArgumentError(nil, "message can no longer be edited")
+	}
+
+	now := time.Now()
+	if _, err := s.db.Exec(`UPDATE chat SET msg=$1, edited_at=$2 WHERE msg_id=$3`, text, now, msgID); err != nil {
+		return Message{}, nil, common.DataBaseError(err)
+	}
+	m.Text, m.EditedAt = text, &now
+	logins, err := s.recipients(m)
+	return m, logins, err
+}
+
+// DeleteMessage marks a message sent by the user as deleted and drops its
+// text. It returns the updated message and the logins to notify.
+func (s *Service) DeleteMessage(userID string, msgID int) (Message, []string, error) {
+	m, fromID, err := s.storedMessage(msgID)
+	if err != nil {
+		return Message{}, nil, err
+	}
+	if fromID != userID {
+		return Message{}, nil, errNotAuthor
+	}
+	if !m.Deleted {
+		if _, err := s.db.Exec(`UPDATE chat SET msg='', deleted=1 WHERE msg_id=$1`, msgID); err != nil {
+			return Message{}, nil, common.DataBaseError(err)
+		}
+	}
+	m.Text, m.Deleted = "", true
+	logins, err := s.recipients(m)
+	return m, logins, err
+}
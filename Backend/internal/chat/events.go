@@ -0,0 +1,136 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"forum/internal/common"
+	"time"
+)
+
+// Messages, edits, receipts and membership changes are numbered per user and
+// kept for EventRetention, so a client which reconnects can ask for the
+// events it missed. Presence, typing indicators and user lists are not kept:
+// a client gets their current state when it connects.
+
+// EventRetention is how long the events of a user can be replayed.
+const EventRetention = 7 * 24 * time.Hour
+
+// maxReplay is the number of events replayed at once.
+const maxReplay = 200
+
+// Replay closes the events replayed for a resume request. The client resumes
+// again from Seq while HasMore is set. Gap means that some events after the
+// requested sequence are no longer kept, and the client should reload the
+// conversations instead.
+type Replay struct {
+	Seq     int64 `json:"seq"`
+	HasMore bool  `json:"has_more"`
+	Gap     bool  `json:"gap,omitempty"`
+}
+
+// RecordEvent numbers the response with the next sequence of the user and
+// stores it.
+func (s *Service) RecordEvent(login string, response *JsonResponse) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRow(`INSERT INTO event_sequences (user_id, last_seq)
+SELECT id, 1 FROM users WHERE login=$1
+ON CONFLICT (user_id) DO UPDATE SET last_seq=last_seq + 1
+RETURNING user_id, last_seq`, login).Scan(&userID, &response.Seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return common.NotFoundError(err, "user not found")
+	}
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO user_events (user_id, seq, payload, created_at) VALUES ($1, $2, $3, $4)`,
+		userID, response.Seq, string(payload), time.Now()); err != nil {
+		return common.DataBaseError(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return common.DataBaseError(err)
+	}
+	return nil
+}
+
+// LastSeq returns the sequence of the latest event of the user, 0 before the
+// first one.
+func (s *Service) LastSeq(userID string) (int64, error) {
+	var seq int64
+	err := s.db.QueryRow(`SELECT last_seq FROM event_sequences WHERE user_id=$1`, userID).Scan(&seq)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, common.DataBaseError(err)
+	}
+	return seq, nil
+}
+
+// EventsSince returns the stored events of the user after the sequence, in
+// order, at most maxReplay of them.
+func (s *Service) EventsSince(userID string, after int64) ([]json.RawMessage, Replay, error) {
+	last, err := s.LastSeq(userID)
+	if err != nil {
+		return nil, Replay{}, err
+	}
+	replay := Replay{Seq: after}
+	if after >= last {
+		// nothing missed, or a sequence from before the events were reset
+		replay.Gap = after > last
+		replay.Seq = last
+		return nil, replay, nil
+	}
+
+	rows, err := s.db.Query(`SELECT seq, payload FROM user_events WHERE user_id=$1 AND seq>$2 ORDER BY seq LIMIT $3`,
+		userID, after, maxReplay+1)
+	if err != nil {
+		return nil, Replay{}, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	var events []json.RawMessage
+	for rows.Next() {
+		var (
+			seq     int64
+			payload string
+		)
+		if err := rows.Scan(&seq, &payload); err != nil {
+			return nil, Replay{}, common.DataBaseError(err)
+		}
+		if len(events) == 0 && seq != after+1 {
+			replay.Gap = true
+		}
+		if len(events) == maxReplay {
+			replay.HasMore = true
+			break
+		}
+		events = append(events, json.RawMessage(payload))
+		replay.Seq = seq
+	}
+	if err := rows.Err(); err != nil {
+		return nil, Replay{}, common.DataBaseError(err)
+	}
+	if len(events) == 0 {
+		// every missed event has expired
+		replay.Gap, replay.Seq = true, last
+	}
+	return events, replay, nil
+}
+
+// PruneEvents deletes the events recorded before the time and returns their
+// number.
+func (s *Service) PruneEvents(before time.Time) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM user_events WHERE created_at < $1`, before)
+	if err != nil {
+		return 0, common.DataBaseError(err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,92 @@
+package chat
+
+import (
+	"encoding/json"
+	"forum/internal/common"
+	"github.com/gorilla/websocket"
+)
+
+// eventsChannel carries the realtime events of all forum instances. Every
+// instance delivers each event to the connections it holds itself, so a
+// message reaches its receiver whichever instance the receiver is connected
+// to.
+const eventsChannel = "forum.chat.events"
+
+const (
+	// eventSend goes to the connections of the listed logins.
+	eventSend = "send"
+	// eventDeliver is a new direct message for one receiver; the instance
+	// which hands it over records the delivery.
+	eventDeliver   = "deliver"
+	eventBroadcast = "broadcast"
+	// eventListUsers asks every instance to refresh the user lists.
+	eventListUsers = "list_users"
+	// eventClose closes the connections of the listed logins.
+	eventClose = "close"
+)
+
+type event struct {
+	Kind     string          `json:"kind"`
+	Logins   []string        `json:"logins,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+func (ws *WS) publish(kind string, logins []string, response *JsonResponse) {
+	e := event{Kind: kind, Logins: logins}
+	if response != nil {
+		data, err := json.Marshal(response)
+		if err != nil {
+			common.ErrorLogger.Println(err)
+			return
+		}
+		e.Response = data
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		common.ErrorLogger.Println(err)
+		return
+	}
+	if err := ws.broker.Publish(eventsChannel, data); err != nil {
+		common.ErrorLogger.Println("cannot publish realtime event:", err)
+	}
+}
+
+// onEvent delivers an event published by any instance to the local
+// connections.
+func (ws *WS) onEvent(data []byte) {
+	var e event
+	if err := json.Unmarshal(data, &e); err != nil {
+		common.ErrorLogger.Println("malformed realtime event:", err)
+		return
+	}
+	switch e.Kind {
+	case eventSend:
+		ws.hub.SendAll(e.Logins, e.Response)
+	case eventBroadcast:
+		ws.hub.Broadcast(e.Response)
+	case eventClose:
+		for _, login := range e.Logins {
+			ws.hub.CloseAll(login, websocket.CloseServiceRestart, "session changed")
+		}
+	case eventListUsers:
+		select {
+		case ws.listUsers <- struct{}{}:
+		default:
+		}
+	case eventDeliver:
+		if len(e.Logins) != 1 || !ws.hub.Send(e.Logins[0], e.Response) {
+			return
+		}
+		var response JsonResponse
+		if err := json.Unmarshal(e.Response, &response); err != nil {
+			common.ErrorLogger.Println(err)
+			return
+		}
+		common.InfoLogger.Printf("Message sent to: %s\n", e.Logins[0])
+		if r, err := ws.chatService.MarkDelivered(response.NewMessage); err != nil {
+			common.ErrorLogger.Println(err)
+		} else if r.Status != "" {
+			ws.sendReceipt(r)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"forum/internal/common"
+	"math"
+)
+
+const (
+	DefaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// HistoryQuery selects a page of a conversation by message ID: the messages
+// before or after a message, or those around it, the message included. At
+// most one of Before, After and Around is set; without any, the page holds the
+// latest messages.
+type HistoryQuery struct {
+	Before int
+	After  int
+	Around int
+	Limit  int
+}
+
+// History is a page of messages, oldest first. HasMore tells that there are
+// older messages than the page, or newer ones for a page after a message.
+// HasNewer tells that there are newer messages than a page around a message.
+type History struct {
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"has_more"`
+	HasNewer bool      `json:"has_newer,omitempty"`
+}
+
+// The direct messages of a pair are found through the chat_dm_index
+// expression index, whatever their direction.
+const dmScope = `min(c.msg_from, c.msg_to) = min($1, $2) AND max(c.msg_from, c.msg_to) = max($1, $2)`
+
+// History returns a page of the direct messages between the two users.
+func (s *Service) History(userID, withID string, q HistoryQuery) (History, error) {
+	return s.history(dmScope, []interface{}{userID, withID}, q)
+}
+
+// ConversationHistory returns a page of the messages of a group the user is a
+// member of, or of a room.
+func (s *Service) ConversationHistory(userID string, convID int, q HistoryQuery) (History, error) {
+	c, err := s.Conversation(convID)
+	if err != nil {
+		return History{}, err
+	}
+	if c.Kind == KindGroup {
+		if _, err := s.memberRole(convID, userID); err != nil {
+			return History{}, err
+		}
+	}
+	h, err := s.history(`c.conversation_id = $1`, []interface{}{convID}, q)
+	if err != nil {
+		return History{}, err
+	}
+	for i := range h.Messages {
+		h.Messages[i].ConversationID = convID
+	}
+	return h, nil
+}
+
+// history pages through the messages matching the scope, a condition on the
+// chat table c with a placeholder for each of the arguments.
+func (s *Service) history(scope string, args []interface{}, q HistoryQuery) (History, error) {
+	cursors := 0
+	for _, id := range []int{q.Before, q.After, q.Around} {
+		if id < 0 {
+			return History{}, common.InvalidArgumentError(errors.New("negative message id"), "invalid message id")
+		}
+		if id > 0 {
+			cursors++
+		}
+	}
+	if cursors > 1 {
+		return History{}, common.InvalidArgumentError(errors.New("several cursors"), "only one of before, after and around can be set")
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+
+	// fetch returns up to n messages past the cursor, oldest first, and
+	// whether the cursor has more.
+	fetch := func(cmp string, id int64, n int) ([]Message, bool, error) {
+		order := "ASC"
+		if cmp[0] == '<' {
+			order = "DESC"
+		}
+		query := fmt.Sprintf(`SELECT * FROM (%s AND c.msg_id %s $%d ORDER BY c.msg_id %s LIMIT $%d)
+ORDER BY msg_id`, historySelect(scope), cmp, len(args)+1, order, len(args)+2)
+		messages, err := s.scanMessages(query, append(args[:len(args):len(args)], id, n+1)...)
+		if err != nil || len(messages) <= n {
+			return messages, false, err
+		}
+		if order == "DESC" {
+			return messages[1:], true, nil
+		}
+		return messages[:n], true, nil
+	}
+
+	var (
+		h   History
+		err error
+	)
+	switch {
+	case q.After > 0:
+		h.Messages, h.HasMore, err = fetch(">", int64(q.After), limit)
+	case q.Around > 0:
+		// the message itself and the older half, then the newer half
+		h.Messages, h.HasMore, err = fetch("<=", int64(q.Around), limit-limit/2)
+		if err != nil {
+			return History{}, err
+		}
+		if n := len(h.Messages); n == 0 || h.Messages[n-1].ID != q.Around {
+			return History{}, common.NotFoundError(errors.New("no such message in the conversation"), "message not found")
+		}
+		var after []Message
+		after, h.HasNewer, err = fetch(">", int64(q.Around), limit/2)
+		h.Messages = append(h.Messages, after...)
+	case q.Before > 0:
+		h.Messages, h.HasMore, err = fetch("<", int64(q.Before), limit)
+	default:
+		h.Messages, h.HasMore, err = fetch("<", math.MaxInt64, limit)
+	}
+	if err != nil {
+		return History{}, err
+	}
+	return h, nil
+}
+
+// historySelect selects the columns read by scanMessages. Senders and
+// receivers may be gone, and messages of conversations have no receiver.
+func historySelect(scope string) string {
+	return `SELECT c.msg_id, coalesce(uf.login, ''), coalesce(ut.login, ''), c.msg, c.send_at, c.msg_from,
+       c.delivered_at, c.read_at, c.edited_at, c.deleted
+FROM chat c
+         LEFT JOIN users uf ON uf.id = c.msg_from
+         LEFT JOIN users ut ON ut.id = c.msg_to
+WHERE ` + scope
+}
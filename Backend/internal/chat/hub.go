@@ -0,0 +1,382 @@
+package chat
+
+import (
+	"encoding/json"
+	"forum/internal/common"
+	"github.com/gorilla/websocket"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SlowConsumerPolicy says what happens to a client which does not read fast
+// enough and lets its outbound queue fill up.
+type SlowConsumerPolicy string
+
+const (
+	// DropMessages discards the messages which do not fit into the queue.
+	DropMessages SlowConsumerPolicy = "drop"
+	// DisconnectSlow closes the connection; the client reconnects and loads
+	// what it missed from the history.
+	DisconnectSlow SlowConsumerPolicy = "disconnect"
+)
+
+func (p SlowConsumerPolicy) IsValid() bool {
+	return p == DropMessages || p == DisconnectSlow
+}
+
+type HubOptions struct {
+	// QueueSize is how many outbound messages wait for a slow connection.
+	QueueSize int
+	// WriteTimeout bounds a single write; a connection which cannot take a
+	// message within it is closed.
+	WriteTimeout time.Duration
+	Policy       SlowConsumerPolicy
+	// PingInterval is how often the server pings every connection, and
+	// PongWait how long it waits for any frame before the connection counts
+	// as dead. PongWait has to be longer than PingInterval.
+	PingInterval time.Duration
+	PongWait     time.Duration
+	// MaxMessageSize limits the frames a client can send.
+	MaxMessageSize int64
+}
+
+// closeGracePeriod bounds the write of a close frame.
+const closeGracePeriod = time.Second
+
+var DefaultHubOptions = HubOptions{
+	QueueSize:      256,
+	WriteTimeout:   10 * time.Second,
+	Policy:         DisconnectSlow,
+	PingInterval:   30 * time.Second,
+	PongWait:       60 * time.Second,
+	MaxMessageSize: 64 * 1024,
+}
+
+// Hub keeps the websocket connections and delivers messages to them. A user
+// can be connected several times, from tabs or devices, and receives every
+// message on each connection. Every connection has its own queue and writer
+// goroutine, so a slow client never delays the others.
+type Hub struct {
+	// counters come first to stay 64-bit aligned for the atomic operations
+	sent         uint64
+	dropped      uint64
+	disconnected uint64
+
+	opts    HubOptions
+	mu      sync.RWMutex
+	clients map[string]map[*Client]struct{}
+}
+
+// Client is a registered connection.
+type Client struct {
+	Login string
+	// Protocol is the version of the chat protocol the connection speaks.
+	Protocol int
+	conn     *websocket.Conn
+	hub      *Hub
+	send     chan []byte
+	done     chan struct{}
+	once     sync.Once
+}
+
+type HubStats struct {
+	Users        int    `json:"users"`
+	Clients      int    `json:"clients"`
+	Sent         uint64 `json:"sent"`
+	Dropped      uint64 `json:"dropped"`
+	Disconnected uint64 `json:"disconnected"`
+}
+
+func NewHub(opts HubOptions) *Hub {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultHubOptions.QueueSize
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = DefaultHubOptions.WriteTimeout
+	}
+	if !opts.Policy.IsValid() {
+		opts.Policy = DefaultHubOptions.Policy
+	}
+	if opts.PingInterval <= 0 {
+		opts.PingInterval = DefaultHubOptions.PingInterval
+	}
+	if opts.PongWait <= opts.PingInterval {
+		opts.PongWait = 2 * opts.PingInterval
+	}
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = DefaultHubOptions.MaxMessageSize
+	}
+	return &Hub{opts: opts, clients: make(map[string]map[*Client]struct{})}
+}
+
+// Register adds a connection of the login. The caller has to read from the
+// connection with Client.ReadMessage until it fails and then unregister it.
+func (h *Hub) Register(login string, conn *websocket.Conn) *Client {
+	c := &Client{
+		Login:    login,
+		Protocol: protocolOf(conn),
+		conn:     conn,
+		hub:      h,
+		send:     make(chan []byte, h.opts.QueueSize),
+		done:     make(chan struct{}),
+	}
+	h.mu.Lock()
+	if h.clients[login] == nil {
+		h.clients[login] = make(map[*Client]struct{})
+	}
+	h.clients[login][c] = struct{}{}
+	h.mu.Unlock()
+
+	conn.SetReadLimit(h.opts.MaxMessageSize)
+	_ = conn.SetReadDeadline(time.Now().Add(h.opts.PongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(h.opts.PongWait))
+	})
+	go c.writePump()
+	return c
+}
+
+// Unregister closes the connection and forgets it. It reports whether it was
+// the last connection of the login. Connections closed for a failed write or
+// a full queue stay registered until their reader unregisters them, so that
+// the reader sees the last connection go.
+func (h *Hub) Unregister(c *Client) bool {
+	last := h.forget(c)
+	c.close()
+	return last
+}
+
+func (h *Hub) forget(c *Client) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	conns, ok := h.clients[c.Login]
+	if !ok {
+		return false
+	}
+	if _, ok := conns[c]; !ok {
+		return false
+	}
+	delete(conns, c)
+	if len(conns) > 0 {
+		return false
+	}
+	delete(h.clients, c.Login)
+	return true
+}
+
+// Connected reports whether the login has a connection.
+func (h *Hub) Connected(login string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients[login]) > 0
+}
+
+// CloseAll closes every connection of the login with the code and reason.
+// Their readers fail and unregister them.
+func (h *Hub) CloseAll(login string, code int, reason string) {
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients[login]))
+	for c := range h.clients[login] {
+		clients = append(clients, c)
+	}
+	h.mu.RUnlock()
+	for _, c := range clients {
+		c.CloseWith(code, reason)
+	}
+}
+
+// Send queues the value for every connection of the login and reports
+// whether any of them took it.
+func (h *Hub) Send(login string, v interface{}) bool {
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients[login]))
+	for c := range h.clients[login] {
+		clients = append(clients, c)
+	}
+	h.mu.RUnlock()
+	return h.fanOut(clients, v)
+}
+
+// SendAll queues the value for every connected login of the list. The value
+// is encoded once.
+func (h *Hub) SendAll(logins []string, v interface{}) {
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(logins))
+	for _, login := range logins {
+		for c := range h.clients[login] {
+			clients = append(clients, c)
+		}
+	}
+	h.mu.RUnlock()
+	h.fanOut(clients, v)
+}
+
+// Broadcast queues the value for every connection.
+func (h *Hub) Broadcast(v interface{}) {
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients))
+	for _, conns := range h.clients {
+		for c := range conns {
+			clients = append(clients, c)
+		}
+	}
+	h.mu.RUnlock()
+	h.fanOut(clients, v)
+}
+
+// fanOut encodes the message once for each protocol spoken by the clients.
+func (h *Hub) fanOut(clients []*Client, v interface{}) bool {
+	if len(clients) == 0 {
+		return false
+	}
+	encoded := make(map[int][]byte, 2)
+	queued := false
+	for _, c := range clients {
+		msg, ok := encoded[c.Protocol]
+		if !ok {
+			var err error
+			if msg, err = encodeFrame(c.Protocol, v); err != nil {
+				common.ErrorLogger.Println(err)
+				return queued
+			}
+			encoded[c.Protocol] = msg
+		}
+		if c.enqueue(msg) {
+			queued = true
+		}
+	}
+	return queued
+}
+
+// Send queues a message for this connection only.
+func (c *Client) Send(v interface{}) bool {
+	return c.hub.fanOut([]*Client{c}, v)
+}
+
+// SendFrame queues a version 2 frame, such as an ack, for this connection.
+func (c *Client) SendFrame(f Frame) bool {
+	msg, err := json.Marshal(f)
+	if err != nil {
+		common.ErrorLogger.Println(err)
+		return false
+	}
+	return c.enqueue(msg)
+}
+
+// Logins returns the connected logins in order.
+func (h *Hub) Logins() []string {
+	h.mu.RLock()
+	logins := make([]string, 0, len(h.clients))
+	for login := range h.clients {
+		logins = append(logins, login)
+	}
+	h.mu.RUnlock()
+	sort.Strings(logins)
+	return logins
+}
+
+func (h *Hub) Stats() HubStats {
+	h.mu.RLock()
+	users, n := len(h.clients), 0
+	for _, conns := range h.clients {
+		n += len(conns)
+	}
+	h.mu.RUnlock()
+	return HubStats{
+		Users:        users,
+		Clients:      n,
+		Sent:         atomic.LoadUint64(&h.sent),
+		Dropped:      atomic.LoadUint64(&h.dropped),
+		Disconnected: atomic.LoadUint64(&h.disconnected),
+	}
+}
+
+// enqueue never blocks. When the queue is full the hub policy decides
+// whether the message is dropped or the client disconnected.
+func (c *Client) enqueue(msg []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+	}
+	if c.hub.opts.Policy == DropMessages {
+		atomic.AddUint64(&c.hub.dropped, 1)
+		return false
+	}
+	if c.CloseWith(websocket.ClosePolicyViolation, "too slow") {
+		atomic.AddUint64(&c.hub.disconnected, 1)
+		common.WarningLogger.Printf("websocket of %s is too slow, disconnecting", c.Login)
+	}
+	return false
+}
+
+// ReadMessage returns the next text or binary message. Any frame, pongs
+// included, proves the connection alive and extends the read deadline. An
+// error means the connection is gone.
+func (c *Client) ReadMessage() ([]byte, error) {
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	_ = c.conn.SetReadDeadline(time.Now().Add(c.hub.opts.PongWait))
+	return data, nil
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.hub.opts.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.hub.opts.WriteTimeout)); err != nil {
+				c.close()
+				return
+			}
+		case msg := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(c.hub.opts.WriteTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				common.WarningLogger.Println("websocket err:", err)
+				c.close()
+				return
+			}
+			atomic.AddUint64(&c.hub.sent, 1)
+		}
+	}
+}
+
+// CloseWith sends a close frame with the code and reason, then closes the
+// connection. The frame is written in the background so a stuck connection
+// does not hold up the caller. It reports whether this call closed it.
+func (c *Client) CloseWith(code int, reason string) bool {
+	msg := websocket.FormatCloseMessage(code, reason)
+	closed := false
+	c.once.Do(func() {
+		close(c.done)
+		go func() {
+			_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeGracePeriod))
+			_ = c.conn.Close()
+		}()
+		closed = true
+	})
+	return closed
+}
+
+// close reports whether this call closed the connection.
+func (c *Client) close() bool {
+	closed := false
+	c.once.Do(func() {
+		close(c.done)
+		_ = c.conn.Close()
+		closed = true
+	})
+	return closed
+}
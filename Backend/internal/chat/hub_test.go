@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// benchClients connects n websocket clients to the hub through an in-process
+// server. The slow ones take 20ms for every message they read, and have small
+// socket buffers so that the hub queues fill up soon. It returns the number
+// of messages received by the fast clients and a function closing everything.
+func benchClients(tb testing.TB, h *Hub, n, slow int) (*int64, func()) {
+	upgrader := websocket.Upgrader{}
+	conns := make(chan *websocket.Conn)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			tb.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+
+	var (
+		received int64
+		wg       sync.WaitGroup
+		clients  []*websocket.Conn
+	)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	for i := 0; i < n; i++ {
+		isSlow := i < slow
+		dialer := *websocket.DefaultDialer
+		if isSlow {
+			dialer.NetDial = func(network, addr string) (net.Conn, error) {
+				conn, err := net.Dial(network, addr)
+				if err == nil {
+					err = conn.(*net.TCPConn).SetReadBuffer(4096)
+				}
+				return conn, err
+			}
+		}
+		conn, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		clients = append(clients, conn)
+		serverConn := <-conns
+		if isSlow {
+			if err := serverConn.UnderlyingConn().(*net.TCPConn).SetWriteBuffer(4096); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		h.Register(fmt.Sprintf("user%d", i), serverConn)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+				if isSlow {
+					time.Sleep(20 * time.Millisecond)
+				} else {
+					atomic.AddInt64(&received, 1)
+				}
+			}
+		}()
+	}
+
+	return &received, func() {
+		for _, conn := range clients {
+			conn.Close()
+		}
+		wg.Wait()
+		srv.Close()
+	}
+}
+
+// BenchmarkHubBroadcast measures a broadcast to every connection, until the
+// fast clients have read it, while a tenth of the clients read slowly and let
+// their queues fill up.
+func BenchmarkHubBroadcast(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		for _, policy := range []SlowConsumerPolicy{DropMessages, DisconnectSlow} {
+			b.Run(fmt.Sprintf("clients=%d/policy=%s", n, policy), func(b *testing.B) {
+				benchmarkHubBroadcast(b, n, n/10, policy)
+			})
+		}
+	}
+}
+
+// maxLag is how many broadcasts the fast clients may be behind, far below
+// the queue size.
+const maxLag = 8
+
+func benchmarkHubBroadcast(b *testing.B, n, slow int, policy SlowConsumerPolicy) {
+	opts := DefaultHubOptions
+	opts.Policy = policy
+	h := NewHub(opts)
+	received, closeAll := benchClients(b, h, n, slow)
+	defer closeAll()
+
+	msg := JsonResponse{Action: "broadcast", NewMessage: Message{ID: 1, From: "alice", Text: strings.Repeat("x", 200)}}
+	fast := int64(n - slow)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Broadcast(msg)
+		// pace the broadcasts by the fast clients, so that only the slow
+		// ones fall behind
+		for atomic.LoadInt64(received) < fast*int64(i+1-maxLag) {
+			time.Sleep(10 * time.Microsecond)
+		}
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt64(received) < fast*int64(b.N) && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Microsecond)
+	}
+	b.StopTimer()
+
+	if got := atomic.LoadInt64(received); got < fast*int64(b.N) {
+		b.Fatalf("fast clients received %d messages, want %d", got, fast*int64(b.N))
+	}
+	stats := h.Stats()
+	b.ReportMetric(float64(stats.Dropped)/float64(b.N), "dropped/op")
+	b.ReportMetric(float64(stats.Disconnected), "disconnected")
+}
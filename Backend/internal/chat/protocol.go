@@ -0,0 +1,250 @@
+package chat
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"forum/internal/common"
+	"github.com/gorilla/websocket"
+	"net/http"
+)
+
+// The websocket speaks two protocols. Version 1 exchanges WSPayload and
+// JsonResponse objects as they are. Version 2, chosen by asking for the
+// ProtocolName subprotocol, wraps every message in a Frame with a type and a
+// typed payload, and answers the commands carrying an id with an ack or a
+// nack frame. Schema describes every version 2 frame.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+
+	ProtocolName = "forum.v2"
+)
+
+// maxCommandID bounds the length of the ids clients give their commands.
+const maxCommandID = 64
+
+// Schema is the JSON Schema of the version 2 frames.
+//
+//go:embed protocol.schema.json
+var Schema []byte
+
+// Frame is a version 2 message. ID is chosen by the client for its commands
+// and repeated in their ack or nack. Seq numbers the events which can be
+// replayed, as JsonResponse.Seq.
+type Frame struct {
+	V       int         `json:"v"`
+	Type    string      `json:"type"`
+	ID      string      `json:"id,omitempty"`
+	Seq     int64       `json:"seq,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// Payloads of the commands.
+type (
+	SendMessageCommand struct {
+		To   string `json:"to"`
+		Text string `json:"text"`
+	}
+	ConversationMessageCommand struct {
+		ConversationID int    `json:"conversation_id"`
+		Text           string `json:"text"`
+	}
+	EditMessageCommand struct {
+		MsgID int    `json:"msg_id"`
+		Text  string `json:"text"`
+	}
+	DeleteMessageCommand struct {
+		MsgID int `json:"msg_id"`
+	}
+	MarkReadCommand struct {
+		From   string `json:"from"`
+		UpToID int    `json:"up_to_msg_id"`
+	}
+	TypingCommand struct {
+		To string `json:"to"`
+	}
+	SetPresenceCommand struct {
+		State        string `json:"state"`
+		CustomStatus string `json:"custom_status"`
+	}
+	ResumeCommand struct {
+		Seq int64 `json:"seq"`
+	}
+)
+
+// Payloads of the events which have no type of their own.
+type (
+	Hello struct {
+		Version int   `json:"version"`
+		Seq     int64 `json:"seq"`
+	}
+	UserList struct {
+		Users []UserInChat `json:"users"`
+	}
+	Typing struct {
+		From string `json:"from"`
+	}
+	ErrorPayload struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	// Ack confirms a command. Sends carry the saved message, and Duplicate
+	// tells that the command repeats one which was already saved.
+	Ack struct {
+		Message   *Message `json:"message,omitempty"`
+		Duplicate bool     `json:"duplicate,omitempty"`
+	}
+)
+
+// commandActions maps the command types to the actions of WSPayload.
+var commandActions = map[string]string{
+	"send_message":         "broadcast",
+	"conversation_message": "conversation_message",
+	"edit_message":         "edit_message",
+	"delete_message":       "delete_message",
+	"mark_read":            "mark_read",
+	"typing_start":         "typing_start",
+	"typing_stop":          "typing_stop",
+	"set_presence":         "set_presence",
+	"resume":               "resume",
+	"leave":                "left",
+}
+
+func protocolOf(conn *websocket.Conn) int {
+	if conn.Subprotocol() == ProtocolName {
+		return ProtocolV2
+	}
+	return ProtocolV1
+}
+
+// decodeCommand reads a version 2 frame into a payload. The id of the frame
+// is kept even when the frame is invalid, to nack it.
+func decodeCommand(data []byte) (WSPayload, error) {
+	var f struct {
+		V       int             `json:"v"`
+		Type    string          `json:"type"`
+		ID      string          `json:"id"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return WSPayload{}, common.InvalidArgumentError(err, "invalid json")
+	}
+	p := WSPayload{ID: f.ID, Action: commandActions[f.Type]}
+	if len(f.ID) > maxCommandID {
+		p.ID = ""
+		return p, common.InvalidArgumentError(nil, fmt.Sprintf("id is longer than %d characters", maxCommandID))
+	}
+	if f.V != ProtocolV2 {
+		return p, common.InvalidArgumentError(nil, fmt.Sprintf("unsupported protocol version %d", f.V))
+	}
+	if p.Action == "" {
+		return p, common.InvalidArgumentError(nil, fmt.Sprintf("unknown type %q", f.Type))
+	}
+
+	unmarshal := func(dst interface{}) error {
+		if len(f.Payload) == 0 {
+			return nil
+		}
+		if err := json.Unmarshal(f.Payload, dst); err != nil {
+			return common.InvalidArgumentError(err, "invalid payload")
+		}
+		return nil
+	}
+	var err error
+	switch f.Type {
+	case "send_message":
+		var c SendMessageCommand
+		err = unmarshal(&c)
+		p.Receiver, p.Message = c.To, c.Text
+	case "conversation_message":
+		var c ConversationMessageCommand
+		err = unmarshal(&c)
+		p.ConversationID, p.Message = c.ConversationID, c.Text
+	case "edit_message":
+		var c EditMessageCommand
+		err = unmarshal(&c)
+		p.MsgID, p.Message = c.MsgID, c.Text
+	case "delete_message":
+		var c DeleteMessageCommand
+		err = unmarshal(&c)
+		p.MsgID = c.MsgID
+	case "mark_read":
+		var c MarkReadCommand
+		err = unmarshal(&c)
+		p.Receiver, p.MsgID = c.From, c.UpToID
+	case "typing_start", "typing_stop":
+		var c TypingCommand
+		err = unmarshal(&c)
+		p.Receiver = c.To
+	case "set_presence":
+		var c SetPresenceCommand
+		err = unmarshal(&c)
+		p.State, p.CustomStatus = c.State, c.CustomStatus
+	case "resume":
+		var c ResumeCommand
+		err = unmarshal(&c)
+		p.Seq = c.Seq
+	}
+	return p, err
+}
+
+// toFrame turns a response into the version 2 event it stands for.
+func toFrame(r JsonResponse) Frame {
+	f := Frame{V: ProtocolV2, Type: r.Action, Seq: r.Seq}
+	switch r.Action {
+	case "broadcast", "conversation_message":
+		m := r.NewMessage
+		f.Type, f.Payload = "message", &m
+	case "message_edited", "message_deleted":
+		m := r.NewMessage
+		f.Payload = &m
+	case "receipt":
+		f.Payload = r.Receipt
+	case "presence":
+		f.Payload = r.Presence
+	case "conversation":
+		f.Payload = r.Conversation
+	case "list_users":
+		f.Type, f.Payload = "user_list", UserList{Users: r.ConnectedUsers}
+	case "typing_start", "typing_stop":
+		f.Payload = Typing{From: r.Sender}
+	case "resumed":
+		f.Payload = r.Replay
+	case "error":
+		f.Payload = ErrorPayload{Code: r.Code, Message: r.Message}
+	}
+	return f
+}
+
+// encodeFrame marshals a message for a connection speaking the protocol.
+// Version 2 connections only get responses, as values or already marshalled.
+func encodeFrame(protocol int, v interface{}) ([]byte, error) {
+	if protocol < ProtocolV2 {
+		return json.Marshal(v)
+	}
+	var r JsonResponse
+	switch v := v.(type) {
+	case JsonResponse:
+		r = v
+	case json.RawMessage:
+		if err := json.Unmarshal(v, &r); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("cannot encode %T as a version 2 frame", v)
+	}
+	return json.Marshal(toFrame(r))
+}
+
+// errorPayload describes a failed command with the status code of its error.
+// Internal errors are logged and reported without their details.
+func errorPayload(err error) ErrorPayload {
+	var appErr *common.AppError
+	if errors.As(err, &appErr) && appErr.StatusCode < http.StatusInternalServerError {
+		return ErrorPayload{Code: appErr.StatusCode, Message: appErr.Message}
+	}
+	common.ErrorLogger.Println(err)
+	return ErrorPayload{Code: http.StatusInternalServerError, Message: http.StatusText(http.StatusInternalServerError)}
+}
@@ -0,0 +1,170 @@
+package chat
+
+import (
+	"forum/internal/common"
+	"time"
+)
+
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// Receipt tells the sender that the messages of a conversation up to UpToID
+// were delivered to or read by the receiver.
+type Receipt struct {
+	Status string    `json:"status"`
+	From   string    `json:"msg_from"`
+	To     string    `json:"msg_to"`
+	UpToID int       `json:"up_to_msg_id"`
+	At     time.Time `json:"at"`
+}
+
+// MarkDelivered records that the message reached the receiver's connection.
+// The receipt is empty when the message was already delivered, to another
+// connection or instance.
+func (s *Service) MarkDelivered(m Message) (Receipt, error) {
+	now := time.Now()
+	res, err := s.db.Exec(`UPDATE chat SET delivered_at=$1 WHERE msg_id=$2 AND delivered_at IS NULL`, now, m.ID)
+	if err != nil {
+		return Receipt{}, common.DataBaseError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Receipt{}, nil
+	}
+	return Receipt{Status: ReceiptDelivered, From: m.From, To: m.To, UpToID: m.ID, At: now}, nil
+}
+
+// MarkAllDelivered records that the messages sent while the user was offline
+// reached the user, and returns one receipt per sender.
+func (s *Service) MarkAllDelivered(userID string) ([]Receipt, error) {
+	rows, err := s.db.Query(`SELECT uf.login, ut.login, max(c.msg_id)
+FROM chat c
+         JOIN users uf ON uf.id = c.msg_from
+         JOIN users ut ON ut.id = c.msg_to
+WHERE c.msg_to = $1 AND c.delivered_at IS NULL
+GROUP BY c.msg_from`, userID)
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var receipts []Receipt
+	for rows.Next() {
+		r := Receipt{Status: ReceiptDelivered, At: now}
+		if err := rows.Scan(&r.From, &r.To, &r.UpToID); err != nil {
+			return nil, common.DataBaseError(err)
+		}
+		receipts = append(receipts, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	rows.Close()
+
+	if _, err := s.db.Exec(`UPDATE chat SET delivered_at=$1 WHERE msg_to=$2 AND delivered_at IS NULL`, now, userID); err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	return receipts, nil
+}
+
+// MarkRead marks the messages the sender sent to the reader up to the message
+// ID as read. The receipt is empty when nothing new was read.
+func (s *Service) MarkRead(readerID, sender string, upToID int) (Receipt, error) {
+	from, err := s.userService.FindByCredential(sender)
+	if err != nil {
+		return Receipt{}, err
+	}
+	to, err := s.userService.FindByCredential(readerID)
+	if err != nil {
+		return Receipt{}, err
+	}
+	now := time.Now()
+	res, err := s.db.Exec(`UPDATE chat SET read_at=$1, delivered_at=coalesce(delivered_at, $1)
+WHERE msg_from=$2 AND msg_to=$3 AND msg_id<=$4 AND read_at IS NULL`, now, from.ID, to.ID, upToID)
+	if err != nil {
+		return Receipt{}, common.DataBaseError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Receipt{}, nil
+	}
+	return Receipt{Status: ReceiptRead, From: from.Login, To: to.Login, UpToID: upToID, At: now}, nil
+}
+
+// UnreadCounts returns the number of unread messages of each of the users
+// per sender ID.
+func (s *Service) UnreadCounts(userIDs []string) (map[string]map[string]int, error) {
+	counts := make(map[string]map[string]int)
+	if len(userIDs) == 0 {
+		return counts, nil
+	}
+	rows, err := s.db.Query(`SELECT msg_to, msg_from, count(*) FROM chat
+WHERE msg_to IN (`+common.Placeholders(1, len(userIDs))+`) AND read_at IS NULL
+GROUP BY msg_to, msg_from`, stringArgs(userIDs)...)
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			to, from string
+			n        int
+		)
+		if err := rows.Scan(&to, &from, &n); err != nil {
+			return nil, common.DataBaseError(err)
+		}
+		if counts[to] == nil {
+			counts[to] = make(map[string]int)
+		}
+		counts[to][from] = n
+	}
+	return counts, rows.Err()
+}
+
+// LastMessageIDs returns, for each of the users, the ID of the latest direct
+// message exchanged with each of their chat partners.
+func (s *Service) LastMessageIDs(userIDs []string) (map[string]map[string]int, error) {
+	last := make(map[string]map[string]int)
+	if len(userIDs) == 0 {
+		return last, nil
+	}
+	in := common.Placeholders(1, len(userIDs))
+	rows, err := s.db.Query(`SELECT msg_from, msg_to, max(msg_id) FROM chat
+WHERE msg_to IS NOT NULL AND (msg_from IN (`+in+`) OR msg_to IN (`+in+`))
+GROUP BY msg_from, msg_to`, stringArgs(userIDs)...)
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	set := func(user, partner string, id int) {
+		if last[user] == nil {
+			last[user] = make(map[string]int)
+		}
+		if id > last[user][partner] {
+			last[user][partner] = id
+		}
+	}
+	for rows.Next() {
+		var (
+			from, to string
+			id       int
+		)
+		if err := rows.Scan(&from, &to, &id); err != nil {
+			return nil, common.DataBaseError(err)
+		}
+		set(from, to, id)
+		set(to, from, id)
+	}
+	return last, rows.Err()
+}
+
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
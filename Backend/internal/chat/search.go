@@ -0,0 +1,233 @@
+package chat
+
+import (
+	"fmt"
+	"forum/internal/common"
+	"forum/internal/user"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	maxSearchContext   = 10
+)
+
+// DefaultSearchContext is how many messages around each hit are returned
+// when the client does not ask for a number.
+const DefaultSearchContext = 2
+
+// The search index is an external content FTS5 table over chat.msg kept in
+// sync by triggers. FTS5 is only compiled into go-sqlite3 with the
+// sqlite_fts5 build tag, which the Makefile sets; a server built without it
+// searches with LIKE, scanning every message.
+const searchSchema = `
+create virtual table chat_fts using fts5(msg, content='chat', content_rowid='msg_id');
+create trigger chat_fts_insert after insert on chat begin
+    insert into chat_fts(rowid, msg) values (new.msg_id, new.msg);
+end;
+create trigger chat_fts_delete after delete on chat begin
+    insert into chat_fts(chat_fts, rowid, msg) values ('delete', old.msg_id, old.msg);
+end;
+create trigger chat_fts_update after update of msg on chat begin
+    insert into chat_fts(chat_fts, rowid, msg) values ('delete', old.msg_id, old.msg);
+    insert into chat_fts(rowid, msg) values (new.msg_id, new.msg);
+end;
+insert into chat_fts(chat_fts) values ('rebuild');`
+
+// initSearch creates the full-text index on first start and reports whether
+// FTS5 is available.
+func (s *Service) initSearch() bool {
+	var n int
+	if err := s.db.QueryRow(`SELECT count() FROM sqlite_master WHERE name='chat_fts'`).Scan(&n); err != nil {
+		common.ErrorLogger.Println(err)
+		return false
+	}
+	if n > 0 {
+		return true
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		common.ErrorLogger.Println(err)
+		return false
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(searchSchema); err != nil {
+		common.ErrorLogger.Printf("full-text search is not available (%v): chat search scans every message; "+
+			"build with make or go build -tags sqlite_fts5", err)
+		return false
+	}
+	if err := tx.Commit(); err != nil {
+		common.ErrorLogger.Println(err)
+		return false
+	}
+	return true
+}
+
+// SearchQuery selects messages of the user's direct chats. With narrows the
+// search to one chat partner; From and To bound the send time.
+type SearchQuery struct {
+	Text    string
+	With    string
+	From    time.Time
+	To      time.Time
+	Context int
+	Page    int
+	Limit   int
+}
+
+// SearchHit is a matching message with the messages around it in the same
+// chat, so the client can jump into the history.
+type SearchHit struct {
+	Message Message   `json:"message"`
+	Before  []Message `json:"before"`
+	After   []Message `json:"after"`
+}
+
+type SearchResult struct {
+	Hits    []SearchHit `json:"hits"`
+	Page    int         `json:"page"`
+	HasMore bool        `json:"has_more"`
+}
+
+// Search returns one page of the user's direct messages matching every word
+// of the query, newest first. Deleted messages are never found.
+func (s *Service) Search(userID string, q SearchQuery) (SearchResult, error) {
+	words := strings.Fields(q.Text)
+	if len(words) == 0 {
+		return SearchResult{}, common.InvalidArgumentError(nil, "search query is required")
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultSearchLimit
+	}
+	if q.Limit > maxSearchLimit {
+		return SearchResult{}, common.InvalidArgumentError(nil, fmt.Sprintf("limit must not exceed %d", maxSearchLimit))
+	}
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.Context < 0 || q.Context > maxSearchContext {
+		return SearchResult{}, common.InvalidArgumentError(nil, fmt.Sprintf("context must be between 0 and %d", maxSearchContext))
+	}
+
+	conds := []string{"c.msg_to IS NOT NULL", "c.deleted = 0", "(c.msg_from = $1 OR c.msg_to = $1)"}
+	args := []interface{}{userID}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if s.fts {
+		add("c.msg_id IN (SELECT rowid FROM chat_fts WHERE chat_fts MATCH $%d)", ftsQuery(words))
+	} else {
+		for _, w := range words {
+			add(`c.msg LIKE $%d ESCAPE '\'`, likeContains(w))
+		}
+	}
+	if q.With != "" {
+		partner, err := s.userService.FindByCredential(q.With)
+		if err != nil {
+			return SearchResult{}, err
+		}
+		add("(c.msg_from = $%[1]d OR c.msg_to = $%[1]d)", partner.ID)
+	}
+	if !q.From.IsZero() {
+		add("c.send_at >= $%d", q.From.UTC())
+	}
+	if !q.To.IsZero() {
+		add("c.send_at < $%d", q.To.UTC())
+	}
+
+	query := fmt.Sprintf(`SELECT c.msg_id, uf.login, ut.login, c.msg, c.send_at, uf.id, c.delivered_at, c.read_at, c.edited_at, c.deleted
+FROM chat c
+         JOIN users uf ON uf.id = c.msg_from
+         JOIN users ut ON ut.id = c.msg_to
+WHERE %s
+ORDER BY c.msg_id DESC
+LIMIT %d OFFSET %d`, strings.Join(conds, " AND "), q.Limit+1, (q.Page-1)*q.Limit)
+	messages, err := s.scanMessages(query, args...)
+	if err != nil {
+		return SearchResult{}, err
+	}
+
+	res := SearchResult{Hits: make([]SearchHit, 0, len(messages)), Page: q.Page}
+	if len(messages) > q.Limit {
+		messages, res.HasMore = messages[:q.Limit], true
+	}
+	for _, m := range messages {
+		hit := SearchHit{Message: m, Before: []Message{}, After: []Message{}}
+		if q.Context > 0 {
+			if hit.Before, err = s.around(m, q.Context, false); err != nil {
+				return SearchResult{}, err
+			}
+			if hit.After, err = s.around(m, q.Context, true); err != nil {
+				return SearchResult{}, err
+			}
+		}
+		res.Hits = append(res.Hits, hit)
+	}
+	return res, nil
+}
+
+// around returns up to n messages of the same chat sent right before or
+// after m, oldest first.
+func (s *Service) around(m Message, n int, after bool) ([]Message, error) {
+	cmp, order := "<", "DESC"
+	if after {
+		cmp, order = ">", "ASC"
+	}
+	query := fmt.Sprintf(`SELECT * FROM (
+                  SELECT c.msg_id, uf.login, ut.login, c.msg, c.send_at, uf.id, c.delivered_at, c.read_at, c.edited_at, c.deleted
+                  FROM chat c
+                           JOIN users uf ON uf.id = c.msg_from
+                           JOIN users ut ON ut.id = c.msg_to
+                  WHERE (uf.login = $1 AND ut.login = $2 OR uf.login = $2 AND ut.login = $1)
+                    AND c.msg_id %s $3
+                  ORDER BY c.msg_id %s
+                  LIMIT $4)
+ORDER BY msg_id`, cmp, order)
+	return s.scanMessages(query, m.From, m.To, m.ID, n)
+}
+
+func (s *Service) scanMessages(query string, args ...interface{}) ([]Message, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var (
+			m      Message
+			fromID string
+		)
+		if err := rows.Scan(&m.ID, &m.From, &m.To, &m.Text, &m.Data, &fromID, &m.DeliveredAt, &m.ReadAt, &m.EditedAt, &m.Deleted); err != nil {
+			return nil, common.DataBaseError(err)
+		}
+		m.Avatar = user.AvatarURL(fromID)
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	return messages, nil
+}
+
+// ftsQuery quotes every word so FTS5 syntax in user input is matched
+// literally, and lets the last word match as a prefix.
+func ftsQuery(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = `"` + strings.ReplaceAll(w, `"`, `""`) + `"`
+	}
+	quoted[len(quoted)-1] += "*"
+	return strings.Join(quoted, " ")
+}
+
+// likeContains escapes the LIKE wildcards in the word and turns it into a
+// substring pattern.
+func likeContains(word string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(word) + "%"
+}
@@ -2,7 +2,7 @@ package chat
 
 import (
 	"database/sql"
-	"fmt"
+	"errors"
 	"forum/internal/common"
 	"forum/internal/user"
 	"strings"
@@ -12,20 +12,31 @@ import (
 type Service struct {
 	db          *sql.DB
 	userService *user.Service
+	// fts reports whether messages are searched through the FTS5 index.
+	fts bool
 }
 
 func NewService(db *sql.DB, us *user.Service) *Service {
-	return &Service{
+	s := &Service{
 		db:          db,
 		userService: us,
 	}
+	s.fts = s.initSearch()
+	return s
 }
 
 type Message struct {
-	From string    `json:"msg_from"`
-	To   string    `json:"msg_to"`
-	Text string    `json:"msg_text"`
-	Data time.Time `json:"data"`
+	ID             int        `json:"msg_id"`
+	From           string     `json:"msg_from"`
+	To             string     `json:"msg_to"`
+	ConversationID int        `json:"conversation_id,omitempty"`
+	Text           string     `json:"msg_text"`
+	Data           time.Time  `json:"data"`
+	Avatar         string     `json:"avatar"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	ReadAt         *time.Time `json:"read_at,omitempty"`
+	EditedAt       *time.Time `json:"edited_at,omitempty"`
+	Deleted        bool       `json:"deleted,omitempty"`
 }
 
 type StringSlice []string
@@ -35,67 +46,84 @@ func (x StringSlice) Len() int { return len(x) }
 func (x StringSlice) Less(i, j int) bool { return strings.ToLower(x[i]) < strings.ToLower(x[j]) }
 func (x StringSlice) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
 
-func (s *Service) SendMessage(sender, receiver, message string) error {
+// SendMessage saves a direct message. The client ID, when given, is the id of
+// the command which sent it; see FindSent.
+func (s *Service) SendMessage(sender, receiver, message, clientID string) (Message, error) {
 	from, err := s.userService.FindByCredential(sender)
 	if err != nil {
-		return err
+		return Message{}, err
 	}
 	to, err := s.userService.FindByCredential(receiver)
 	if err != nil {
-		return err
+		return Message{}, err
 	}
-	if _, err := s.db.Exec(`INSERT INTO chat (msg_from, msg_to, msg) VALUES ($1, $2, $3)`, from.ID, to.ID, message); err != nil {
+	blocked, err := s.userService.IsBlocked(to.ID, from.ID)
+	if err != nil {
+		return Message{}, err
+	}
+	if blocked {
+		return Message{}, user.ErrBlocked
+	}
+	m := Message{From: from.Login, To: to.Login, Text: message, Avatar: user.AvatarURL(from.ID)}
+	row := s.db.QueryRow(`INSERT INTO chat (msg_from, msg_to, msg, client_id) VALUES ($1, $2, $3, nullif($4, '')) returning msg_id, send_at`,
+		from.ID, to.ID, message, clientID)
+	if err := row.Scan(&m.ID, &m.Data); err != nil {
 		common.WarningLogger.Println("DB error: ", err)
-		return err
+		return Message{}, err
 	}
 
-	return nil
+	return m, nil
 }
 
-func (s *Service) CountMessages(sender, receiver string) (int, error) {
-	row := s.db.QueryRow(`SELECT count()
-FROM chat as c
-         JOIN users uf ON c.msg_from = uf.id
-         JOIN users ut ON c.msg_to = ut.id
-WHERE c.msg_from = $sender AND c.msg_to = $receiver
-   OR c.msg_from = $receiver AND c.msg_to = $sender
-ORDER BY send_at asc `, sender, receiver)
-
-	var nOfMessages int
-
-	err := row.Scan(&nOfMessages)
+// FindSent returns the message the user sent with the command of the client
+// ID, if any, so that a command retried by the client is not saved twice.
+func (s *Service) FindSent(userID, clientID string) (Message, bool, error) {
+	if clientID == "" {
+		return Message{}, false, nil
+	}
+	var (
+		m      Message
+		convID sql.NullInt64
+	)
+	err := s.db.QueryRow(`SELECT c.msg_id, coalesce(uf.login, ''), coalesce(ut.login, ''), c.conversation_id, c.msg, c.send_at,
+       c.delivered_at, c.read_at, c.edited_at, c.deleted
+FROM chat c
+         LEFT JOIN users uf ON uf.id = c.msg_from
+         LEFT JOIN users ut ON ut.id = c.msg_to
+WHERE c.msg_from = $1 AND c.client_id = $2`, userID, clientID).
+		Scan(&m.ID, &m.From, &m.To, &convID, &m.Text, &m.Data, &m.DeliveredAt, &m.ReadAt, &m.EditedAt, &m.Deleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Message{}, false, nil
+	}
 	if err != nil {
-		fmt.Println(err)
+		return Message{}, false, common.DataBaseError(err)
 	}
-	return nOfMessages, nil
+	m.ConversationID = int(convID.Int64)
+	m.Avatar = user.AvatarURL(userID)
+	return m, true, nil
 }
 
-func (s *Service) GetMessages(sender, receiver string, skip, limit int) ([]Message, error) {
-	rows, err := s.db.Query(`SELECT * FROM (
-                  SELECT uf.login, ut.login, c.msg, c.send_at
-                  FROM chat as c
-                           JOIN users uf ON c.msg_from = uf.id
-                           JOIN users ut ON c.msg_to = ut.id
-                  WHERE c.msg_from = $1 AND c.msg_to = $2
-                     OR c.msg_from = $2 AND c.msg_to = $1
-                  ORDER BY send_at DESC
-                  LIMIT $3, $4)
-ORDER BY send_at ASC;`, sender, receiver, skip, limit)
+// MessagesOfUser returns every message the user sent or received, oldest first.
+func (s *Service) MessagesOfUser(userID string) ([]Message, error) {
+	rows, err := s.db.Query(`SELECT c.msg_id, coalesce(uf.login, ''), coalesce(ut.login, ''), c.msg, c.send_at, c.delivered_at, c.read_at, c.edited_at, c.deleted
+FROM chat as c
+         LEFT JOIN users uf ON c.msg_from = uf.id
+         LEFT JOIN users ut ON c.msg_to = ut.id
+WHERE c.msg_from = $1 OR c.msg_to = $1
+ORDER BY c.msg_id`, userID)
 	if err != nil {
-		return nil, err
+		return nil, common.SystemError(err)
 	}
 	defer rows.Close()
 
-	var messages []Message
+	messages := []Message{}
 	for rows.Next() {
 		var m Message
-		err := rows.Scan(&m.From, &m.To, &m.Text, &m.Data)
-		if err != nil {
+		if err := rows.Scan(&m.ID, &m.From, &m.To, &m.Text, &m.Data, &m.DeliveredAt, &m.ReadAt, &m.EditedAt, &m.Deleted); err != nil {
 			common.InfoLogger.Println(err)
 			continue
 		}
 		messages = append(messages, m)
 	}
-	fmt.Println(messages)
 	return messages, nil
 }
@@ -0,0 +1,98 @@
+package chat
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// typingThrottle is how often a typing_start is relayed per conversation;
+	// clients may send one on every key press.
+	typingThrottle = 3 * time.Second
+	// typingExpiry stops the indicator when the client neither sends another
+	// start nor a stop, for example because it lost the connection.
+	typingExpiry = 6 * time.Second
+)
+
+type typingKey struct {
+	from, to string
+}
+
+type typingState struct {
+	relayedAt time.Time
+	expiry    *time.Timer
+}
+
+// typingTracker remembers who is typing to whom.
+type typingTracker struct {
+	mu     sync.Mutex
+	active map[typingKey]*typingState
+	// expired is called when an indicator expires without a stop.
+	expired func(from, to string)
+}
+
+func newTypingTracker(expired func(from, to string)) *typingTracker {
+	return &typingTracker{active: make(map[typingKey]*typingState), expired: expired}
+}
+
+// start reports whether the typing_start should be relayed to the receiver.
+func (t *typingTracker) start(from, to string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := typingKey{from, to}
+	now := time.Now()
+	if st, ok := t.active[key]; ok {
+		st.expiry.Reset(typingExpiry)
+		if now.Sub(st.relayedAt) < typingThrottle {
+			return false
+		}
+		st.relayedAt = now
+		return true
+	}
+
+	st := &typingState{relayedAt: now}
+	st.expiry = time.AfterFunc(typingExpiry, func() {
+		t.mu.Lock()
+		if t.active[key] != st {
+			t.mu.Unlock()
+			return
+		}
+		delete(t.active, key)
+		t.mu.Unlock()
+		t.expired(from, to)
+	})
+	t.active[key] = st
+	return true
+}
+
+// stop reports whether the sender was typing, so the stop has to be relayed.
+func (t *typingTracker) stop(from, to string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := typingKey{from, to}
+	st, ok := t.active[key]
+	if !ok {
+		return false
+	}
+	st.expiry.Stop()
+	delete(t.active, key)
+	return true
+}
+
+// stopAll ends every indicator of the sender and returns the receivers.
+func (t *typingTracker) stopAll(from string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var receivers []string
+	for key, st := range t.active {
+		if key.from == from {
+			st.expiry.Stop()
+			delete(t.active, key)
+			receivers = append(receivers, key.to)
+		}
+	}
+	return receivers
+}
@@ -1,192 +1,614 @@
 package chat
 
 import (
+	"encoding/json"
 	"fmt"
+	"forum/internal/broker"
 	"forum/internal/common"
 	"forum/internal/user"
 	"github.com/gorilla/websocket"
+	uuid "github.com/satori/go.uuid"
 	"log"
+	"sort"
 	"sync"
 	"time"
 )
 
 type WS struct {
-	cl          sync.Map
+	hub         *Hub
+	broker      broker.Broker
 	wsChan      chan WSPayload
 	userService *user.Service
 	chatService *Service
-	mu          sync.Mutex
+	// presence holds the last presence pushed for each user ID.
+	presence sync.Map
+	typing   *typingTracker
+	// listUsers coalesces requests to refresh the user lists of all clients.
+	listUsers chan struct{}
+	// instanceID names the connections of this instance in the presence
+	// records.
+	instanceID string
+	// connMu orders the presence writes of concurrent connects and
+	// disconnects.
+	connMu sync.Mutex
 }
 
-func NewWS(uService *user.Service, cS *Service) *WS {
+const presenceCheckInterval = 30 * time.Second
+
+// NewWS starts the realtime chat. Events go through the broker, so users
+// connected to other instances sharing it receive them too.
+func NewWS(uService *user.Service, cS *Service, opts HubOptions, b broker.Broker) *WS {
 	w := &WS{}
+	w.hub = NewHub(opts)
+	w.broker = b
 	w.wsChan = make(chan WSPayload)
+	w.listUsers = make(chan struct{}, 1)
 	w.userService = uService
 	w.chatService = cS
+	w.typing = newTypingTracker(w.typingExpired)
+	w.instanceID = uuid.NewV4().String()
+	if err := b.Subscribe(eventsChannel, w.onEvent); err != nil {
+		common.ErrorLogger.Println(err)
+	}
 	go w.listenToWsChannel()
+	go w.watchPresence()
+	go w.heartbeat()
+	go w.refreshUserLists()
+	go w.pruneEvents()
 	return w
 }
 
-type WSConnection struct {
-	*websocket.Conn
-}
-
 type WSPayload struct {
-	Action   string       `json:"action"`
-	Message  string       `json:"message"`
-	UserName string       `json:"user_name"`
-	Receiver string       `json:"receiver"`
-	Conn     WSConnection `json:"-"`
+	Action         string `json:"action"`
+	Message        string `json:"message"`
+	UserName       string `json:"user_name"`
+	Receiver       string `json:"receiver"`
+	State          string `json:"state"`
+	CustomStatus   string `json:"custom_status"`
+	MsgID          int    `json:"msg_id"`
+	ConversationID int    `json:"conversation_id"`
+	Seq            int64  `json:"seq"`
+	// ID is the id a version 2 client gave the command.
+	ID     string  `json:"-"`
+	UserID string  `json:"-"`
+	Client *Client `json:"-"`
 }
 
 type JsonResponse struct {
-	Action         string       `json:"action"`
-	Message        string       `json:"message"`
-	NewMessage     Message      `json:"new_message"`
-	Sender         string       `json:"sender"`
-	ConnectedUsers []UserInChat `json:"connected_users"`
-	Receiver       string       `json:"-"`
+	Action         string         `json:"action"`
+	Message        string         `json:"message"`
+	NewMessage     Message        `json:"new_message"`
+	Sender         string         `json:"sender"`
+	ConnectedUsers []UserInChat   `json:"connected_users"`
+	Presence       *user.Presence `json:"presence,omitempty"`
+	Receipt        *Receipt       `json:"receipt,omitempty"`
+	Conversation   *Conversation  `json:"conversation,omitempty"`
+	Replay         *Replay        `json:"replay,omitempty"`
+	// Code is the status code of an error.
+	Code int `json:"code,omitempty"`
+	// Seq numbers the events of the receiving user which can be replayed.
+	Seq      int64  `json:"seq,omitempty"`
+	Receiver string `json:"-"`
 }
 
-func (ws *WS) StartListener(webS *websocket.Conn, userLogin string) error {
+// StartListener greets the connection with the sequence of the latest event
+// of the user, from which a later connection can resume.
+func (ws *WS) StartListener(webS *websocket.Conn, userID, userLogin string) error {
 	var msg JsonResponse
 	msg.Message = `<em><small>Connected to Server</small></em>`
+	seq, err := ws.chatService.LastSeq(userID)
+	if err != nil {
+		return err
+	}
+	msg.Seq = seq
 
-	conn := WSConnection{Conn: webS}
-	err := webS.WriteJSON(msg)
+	if protocolOf(webS) == ProtocolV2 {
+		err = webS.WriteJSON(Frame{V: ProtocolV2, Type: "hello", Payload: Hello{Version: ProtocolV2, Seq: seq}})
+	} else {
+		err = webS.WriteJSON(msg)
+	}
 	if err != nil {
 		return err
 	}
-	go ws.listenToWs(conn, userLogin)
+	go ws.listenToWs(webS, userID, userLogin)
 	return nil
 }
 
-func (ws *WS) listenToWs(conn WSConnection, login string) {
+// connect registers a connection; the user is online from the first one.
+func (ws *WS) connect(conn *websocket.Conn, userID, login string) *Client {
+	ws.connMu.Lock()
+	defer ws.connMu.Unlock()
+	first := !ws.hub.Connected(login)
+	client := ws.hub.Register(login, conn)
+	if first {
+		if err := ws.userService.SetConnected(userID, ws.instanceID, true); err != nil {
+			common.ErrorLogger.Println(err)
+		}
+	}
+	return client
+}
+
+// disconnect closes a connection; the user goes offline with the last one.
+func (ws *WS) disconnect(client *Client, userID string) {
+	ws.connMu.Lock()
+	last := ws.hub.Unregister(client)
+	if last {
+		if err := ws.userService.SetConnected(userID, ws.instanceID, false); err != nil {
+			common.ErrorLogger.Println(err)
+		}
+	}
+	ws.connMu.Unlock()
+	if !last {
+		return
+	}
+	for _, to := range ws.typing.stopAll(client.Login) {
+		if ws.mayNotify(userID, to) {
+			ws.sendTyping("typing_stop", client.Login, to)
+		}
+	}
+	ws.PushPresence(userID)
+}
+
+func (ws *WS) listenToWs(conn *websocket.Conn, userID, login string) {
+	client := ws.connect(conn, userID, login)
 	defer func() {
-		ws.cl.Delete(login)
-		ws.SendListUsers()
+		ws.disconnect(client, userID)
 		if r := recover(); r != nil {
 			log.Println("Error", fmt.Sprintf("%v", r))
 		}
 	}()
-	ws.cl.Store(login, conn)
-	ws.SendListUsers()
-	var payload WSPayload
+	ws.sendListUsers(login)
+	ws.PushPresence(userID)
+	ws.deliverPending(userID)
 	for {
-		err := conn.ReadJSON(&payload)
+		data, err := client.ReadMessage()
 		if err != nil {
-			//fmt.Println("cannot read JSON: ", err)
-		} else {
-			payload.Conn = conn
-			payload.UserName = login
-			ws.wsChan <- payload
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				common.InfoLogger.Printf("websocket of %s closed: %v", login, err)
+			}
+			return
+		}
+		payload, err := ws.decode(client, data)
+		payload.Client = client
+		payload.UserName = login
+		payload.UserID = userID
+		if err != nil {
+			ws.reply(payload, nil, err)
+			continue
 		}
+		ws.touch(userID)
+		ws.wsChan <- payload
 	}
 }
 
 func (ws *WS) listenToWsChannel() {
-	var response JsonResponse
-
 	for {
 		e := <-ws.wsChan
-		switch e.Action {
+		ack, err := ws.handle(e)
+		ws.reply(e, ack, err)
+	}
+}
 
-		case "left":
-			ws.cl.Delete(e.UserName)
-			ws.SendListUsers()
+// handle runs a command. Commands which save a message return it in the ack.
+func (ws *WS) handle(e WSPayload) (*Ack, error) {
+	switch e.Action {
 
-		case "broadcast":
-			if err := ws.chatService.SendMessage(e.UserName, e.Receiver, e.Message); err != nil {
-				response.Action = "error"
-				response.Message = fmt.Sprintf("Message was not save, DB error: %s", err)
-				break
-			}
-			ws.SendListUsers()
-			response.Action = "broadcast"
+	case "left":
+		e.Client.CloseWith(websocket.CloseNormalClosure, "")
+		ws.disconnect(e.Client, e.UserID)
 
-			var messages Message
+	case "resume":
+		ws.replay(e.Client, e.UserID, e.Seq)
 
-			messages.Text = e.Message
-			messages.To = e.Receiver
-			messages.From = e.UserName
-			messages.Data = time.Now()
+	case "set_presence":
+		if err := ws.userService.SetPresence(e.UserID, user.PresenceState(e.State), e.CustomStatus); err != nil {
+			return nil, err
+		}
+		ws.PushPresence(e.UserID)
 
-			response.NewMessage = messages
+	case "typing_start":
+		// blocked pairs are not tracked, so their indicators never expire
+		// into a typing_stop either
+		if ws.mayNotify(e.UserID, e.Receiver) && ws.typing.start(e.UserName, e.Receiver) {
+			ws.sendTyping(e.Action, e.UserName, e.Receiver)
+		}
 
-			//response.Message = e.Message
-			//response.Sender = e.UserName
-			//response.Receiver = e.Receiver
-			if ws.sendOne(response, e.UserName) {
-				common.InfoLogger.Printf("Message sent to: %s\n", e.UserName)
-			} else {
-				common.InfoLogger.Printf("Cannot send a message to %s, no ws connection\n", e.UserName)
-			}
-			if ws.sendOne(response, e.Receiver) {
-				common.InfoLogger.Printf("Message sent to: %s\n", e.Receiver)
-			} else {
-				common.InfoLogger.Printf("Cannot send a message to %s, no ws connection\n", e.Receiver)
-			}
+	case "typing_stop":
+		if ws.typing.stop(e.UserName, e.Receiver) && ws.mayNotify(e.UserID, e.Receiver) {
+			ws.sendTyping(e.Action, e.UserName, e.Receiver)
+		}
+
+	case "mark_read":
+		r, err := ws.chatService.MarkRead(e.UserID, e.Receiver, e.MsgID)
+		if err != nil {
+			return nil, err
+		}
+		if r.Status != "" {
+			ws.sendReceipt(r)
+			ws.sendListUsers(e.UserName)
+		}
+
+	case "conversation_message":
+		if m, ok, err := ws.chatService.FindSent(e.UserID, e.ID); err != nil || ok {
+			return &Ack{Message: &m, Duplicate: ok}, err
+		}
+		message, logins, err := ws.chatService.SendToConversation(e.UserID, e.ConversationID, e.Message, e.ID)
+		if err != nil {
+			return nil, err
 		}
+		ws.notify(eventSend, JsonResponse{Action: e.Action, NewMessage: message}, logins...)
+		return &Ack{Message: &message}, nil
+
+	case "edit_message":
+		message, logins, err := ws.chatService.EditMessage(e.UserID, e.MsgID, e.Message)
+		if err != nil {
+			return nil, err
+		}
+		ws.notify(eventSend, JsonResponse{Action: "message_edited", NewMessage: message}, logins...)
+		return &Ack{Message: &message}, nil
+
+	case "delete_message":
+		message, logins, err := ws.chatService.DeleteMessage(e.UserID, e.MsgID)
+		if err != nil {
+			return nil, err
+		}
+		ws.notify(eventSend, JsonResponse{Action: "message_deleted", NewMessage: message}, logins...)
+		return &Ack{Message: &message}, nil
+
+	case "broadcast":
+		if m, ok, err := ws.chatService.FindSent(e.UserID, e.ID); err != nil || ok {
+			return &Ack{Message: &m, Duplicate: ok}, err
+		}
+		message, err := ws.chatService.SendMessage(e.UserName, e.Receiver, e.Message, e.ID)
+		if err != nil {
+			return nil, err
+		}
+		ws.typing.stop(e.UserName, e.Receiver)
+		// only the lists of the two get a new order and unread count
+		ws.sendListUsers(e.UserName, e.Receiver)
+		response := JsonResponse{Action: "broadcast", NewMessage: message}
+		ws.notify(eventSend, response, e.UserName)
+		ws.notify(eventDeliver, response, e.Receiver)
+		return &Ack{Message: &message}, nil
+
+	default:
+		return nil, common.InvalidArgumentError(nil, fmt.Sprintf("unknown action %q", e.Action))
+	}
+	return nil, nil
+}
+
+// reply acks or nacks a version 2 command carrying an id. Other failed
+// commands are reported with an error frame.
+func (ws *WS) reply(e WSPayload, ack *Ack, err error) {
+	if e.ID == "" {
+		if err != nil {
+			ws.sendError(err, e.UserName)
+		}
+		return
+	}
+	if err != nil {
+		e.Client.SendFrame(Frame{V: ProtocolV2, Type: "nack", ID: e.ID, Payload: errorPayload(err)})
+		return
+	}
+	if ack == nil {
+		ack = &Ack{}
 	}
+	e.Client.SendFrame(Frame{V: ProtocolV2, Type: "ack", ID: e.ID, Payload: ack})
 }
 
+// Reconnect closes the connections of the login on every instance, after the
+// user changed it: the hub and the typing indicators know connections by
+// login, so the clients have to connect again under the new one. It also ends
+// the connections of an erased account, whose sessions are gone, so they
+// cannot connect again.
+func (ws *WS) Reconnect(login string) {
+	ws.publish(eventClose, []string{login}, nil)
+}
+
+// SendListUsers asks for the user lists of all clients, on every instance, to
+// be refreshed. The lists are built in the background and requests made
+// meanwhile are merged.
 func (ws *WS) SendListUsers() {
-	var response JsonResponse
-	ws.cl.Range(func(key, value interface{}) bool {
-		if login, ok := key.(string); ok {
-			users := ws.getListOfUsers(login)
-			response.Action = "list_users"
-			response.ConnectedUsers = users
-			ws.sendOne(response, login)
+	ws.publish(eventListUsers, nil, nil)
+}
+
+func (ws *WS) refreshUserLists() {
+	for range ws.listUsers {
+		logins := ws.hub.Logins()
+		lists := ws.userLists(logins)
+		for _, login := range logins {
+			ws.hub.Send(login, JsonResponse{Action: "list_users", ConnectedUsers: lists[login]})
 		}
+	}
+}
 
-		return true
-	})
+// sendListUsers refreshes the user lists of the logins only, on whichever
+// instance they are connected to.
+func (ws *WS) sendListUsers(logins ...string) {
+	lists := ws.userLists(logins)
+	for _, login := range logins {
+		ws.sendOne(JsonResponse{Action: "list_users", ConnectedUsers: lists[login]}, login)
+	}
 }
 
 type UserInChat struct {
-	UserLogin    string `json:"user_login"`
-	OnlineStatus bool   `json:"online_status"`
-	UserId       string `json:"user_id"`
+	UserLogin    string             `json:"user_login"`
+	OnlineStatus bool               `json:"online_status"`
+	UserId       string             `json:"user_id"`
+	Avatar       string             `json:"avatar"`
+	State        user.PresenceState `json:"state"`
+	CustomStatus string             `json:"custom_status,omitempty"`
+	LastSeen     *time.Time         `json:"last_seen,omitempty"`
+	Unread       int                `json:"unread"`
 }
 
-func (ws *WS) getListOfUsers(login string) []UserInChat {
-	var onlineUsers []UserInChat
-	usersFromDB, err := ws.userService.FindAllUsers(login)
+// userLists builds the user list of each of the logins: everyone but the
+// viewer and the users it blocked, latest chat partners first, then by login.
+// The queries are shared by all the lists.
+func (ws *WS) userLists(logins []string) map[string][]UserInChat {
+	lists := make(map[string][]UserInChat, len(logins))
+	users, err := ws.userService.ChatDirectory()
 	if err != nil {
-		fmt.Println(err)
+		common.ErrorLogger.Println(err)
+		return lists
+	}
+	presences, err := ws.userService.Presences()
+	if err != nil {
+		common.ErrorLogger.Println(err)
 	}
 
-	for _, u := range usersFromDB {
-		var us UserInChat
-		us.UserLogin = u.Login
-		us.UserId = u.ID
-		_, us.OnlineStatus = ws.cl.Load(u.Login)
-		fmt.Println("Status: ", us.UserLogin, us.OnlineStatus)
-		onlineUsers = append(onlineUsers, us)
+	ids := make(map[string]string, len(users))
+	for _, u := range users {
+		ids[u.Login] = u.ID
+	}
+	viewers := make([]string, 0, len(logins))
+	for _, login := range logins {
+		if id, ok := ids[login]; ok {
+			viewers = append(viewers, id)
+		}
+	}
+	blocked, err := ws.userService.BlockedByEach(viewers)
+	if err != nil {
+		common.ErrorLogger.Println(err)
+	}
+	unread, err := ws.chatService.UnreadCounts(viewers)
+	if err != nil {
+		common.ErrorLogger.Println(err)
+	}
+	last, err := ws.chatService.LastMessageIDs(viewers)
+	if err != nil {
+		common.ErrorLogger.Println(err)
+	}
+
+	all := make([]UserInChat, len(users))
+	for i, u := range users {
+		us := UserInChat{UserLogin: u.Login, UserId: u.ID, Avatar: user.AvatarURL(u.ID), State: user.PresenceOffline}
+		if p, ok := presences[u.ID]; ok {
+			us.State, us.CustomStatus, us.LastSeen = p.State, p.CustomStatus, p.LastSeen
+		}
+		us.OnlineStatus = us.State != user.PresenceOffline
+		all[i] = us
+	}
+	for _, login := range logins {
+		viewer, ok := ids[login]
+		if !ok {
+			continue
+		}
+		list := make([]UserInChat, 0, len(all))
+		for _, us := range all {
+			if us.UserId == viewer || blocked[viewer][us.UserId] {
+				continue
+			}
+			us.Unread = unread[viewer][us.UserId]
+			list = append(list, us)
+		}
+		sort.SliceStable(list, func(i, j int) bool {
+			return last[viewer][list[i].UserId] > last[viewer][list[j].UserId]
+		})
+		lists[login] = list
+	}
+	return lists
+}
+
+// sendTyping relays a typing indicator to the receiver only.
+func (ws *WS) sendTyping(action, from, to string) {
+	ws.sendOne(JsonResponse{Action: action, Sender: from}, to)
+}
+
+// typingExpired relays the stop of an indicator which timed out, unless the
+// receiver blocked the sender since it started.
+func (ws *WS) typingExpired(from, to string) {
+	u, err := ws.userService.FindByCredential(from)
+	if err != nil {
+		return
+	}
+	if ws.mayNotify(u.ID, to) {
+		ws.sendTyping("typing_stop", from, to)
+	}
+}
+
+// mayNotify reports whether the receiver accepts notifications from the user,
+// which it does unless it blocked the user.
+func (ws *WS) mayNotify(userID, receiver string) bool {
+	to, err := ws.userService.FindByCredential(receiver)
+	if err != nil {
+		return false
+	}
+	blocked, err := ws.userService.IsBlocked(to.ID, userID)
+	if err != nil {
+		common.ErrorLogger.Println(err)
+		return false
+	}
+	return !blocked
+}
+
+// sendReceipt tells the sender of the messages that they were delivered or
+// read.
+func (ws *WS) sendReceipt(r Receipt) {
+	ws.notify(eventSend, JsonResponse{Action: "receipt", Receipt: &r}, r.From)
+}
+
+// deliverPending marks the messages received while the user was offline as
+// delivered and notifies their senders.
+func (ws *WS) deliverPending(userID string) {
+	receipts, err := ws.chatService.MarkAllDelivered(userID)
+	if err != nil {
+		common.ErrorLogger.Println(err)
+		return
+	}
+	for _, r := range receipts {
+		ws.sendReceipt(r)
+	}
+}
+
+// PushPresence sends the current presence of the user to every connected
+// client.
+func (ws *WS) PushPresence(userID string) {
+	p, err := ws.userService.Presence(userID)
+	if err != nil {
+		common.ErrorLogger.Println(err)
+		return
+	}
+	ws.presence.Store(userID, p)
+	ws.broadcastToAll(JsonResponse{Action: "presence", Presence: &p})
+}
+
+// touch records activity and brings the user back from away.
+func (ws *WS) touch(userID string) {
+	if err := ws.userService.Touch(userID); err != nil {
+		common.ErrorLogger.Println(err)
+		return
+	}
+	if p, ok := ws.presence.Load(userID); ok && p.(user.Presence).State == user.PresenceAway {
+		ws.PushPresence(userID)
+	}
+}
+
+// watchPresence pushes the presence changes which happen without any request,
+// users going away after inactivity.
+func (ws *WS) watchPresence() {
+	ticker := time.NewTicker(presenceCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		presences, err := ws.userService.Presences()
+		if err != nil {
+			common.ErrorLogger.Println(err)
+			continue
+		}
+		for id, p := range presences {
+			// Every instance reports the users connected to it.
+			old, ok := ws.presence.Load(id)
+			if !ok || !ws.hub.Connected(p.Login) {
+				continue
+			}
+			if o := old.(user.Presence); o.State != p.State || o.CustomStatus != p.CustomStatus {
+				p := p
+				ws.presence.Store(id, p)
+				ws.broadcastToAll(JsonResponse{Action: "presence", Presence: &p})
+			}
+		}
+	}
+}
+
+// heartbeat keeps the connections of this instance from expiring in the
+// presence records, and reports the users left online by an instance which
+// stopped.
+func (ws *WS) heartbeat() {
+	ticker := time.NewTicker(user.HeartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		expired, err := ws.userService.Heartbeat(ws.instanceID)
+		if err != nil {
+			common.ErrorLogger.Println(err)
+			continue
+		}
+		for _, id := range expired {
+			ws.PushPresence(id)
+		}
 	}
-	return onlineUsers
+}
+
+// PushConversation tells the connected members of a conversation, and anyone
+// who just left it, that its membership changed.
+func (ws *WS) PushConversation(c Conversation, also ...string) {
+	response := JsonResponse{Action: "conversation", Conversation: &c}
+	for _, m := range c.Members {
+		ws.notify(eventSend, response, m.Login)
+	}
+	ws.notify(eventSend, response, also...)
 }
 
 func (ws *WS) broadcastToAll(response JsonResponse) {
-	ws.cl.Range(func(key, value interface{}) bool {
-		ws.sendOne(response, key.(string))
-		return true
-	})
-}
-
-func (ws *WS) sendOne(response JsonResponse, sendTo string) bool {
-	ws.mu.Lock()
-	defer ws.mu.Unlock()
-	if conn, ok := ws.cl.Load(sendTo); ok {
-		c := conn.(WSConnection)
-		if err := c.WriteJSON(response); err != nil {
-			common.WarningLogger.Println("websocket err:", err)
-			_ = c.Close()
-			ws.cl.Delete(sendTo)
-			return false
-		}
-		return true
-	}
-	return false
+	ws.publish(eventBroadcast, nil, &response)
+}
+
+// decode reads a command in the protocol of the connection.
+func (ws *WS) decode(client *Client, data []byte) (WSPayload, error) {
+	if client.Protocol == ProtocolV2 {
+		return decodeCommand(data)
+	}
+	var payload WSPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return WSPayload{}, common.InvalidArgumentError(err, "invalid json")
+	}
+	return payload, nil
+}
+
+// notify records the response as the next event of each user, so that it can
+// be replayed, and publishes it.
+func (ws *WS) notify(kind string, response JsonResponse, logins ...string) {
+	for _, login := range logins {
+		r := response
+		if err := ws.chatService.RecordEvent(login, &r); err != nil {
+			common.ErrorLogger.Println(err)
+			continue
+		}
+		ws.publish(kind, []string{login}, &r)
+	}
+}
+
+// replay sends the events of the user after the sequence to the connection
+// which resumes, then the sequence to resume from next. Events published
+// meanwhile may come in between; the client skips the sequences it already
+// has.
+func (ws *WS) replay(client *Client, userID string, after int64) {
+	events, replay, err := ws.chatService.EventsSince(userID, after)
+	if err != nil {
+		ws.sendError(err, client.Login)
+		return
+	}
+	for _, e := range events {
+		client.Send(e)
+	}
+	client.Send(JsonResponse{Action: "resumed", Replay: &replay})
+}
+
+// pruneEvents deletes the events kept for longer than EventRetention.
+func (ws *WS) pruneEvents() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		n, err := ws.chatService.PruneEvents(time.Now().Add(-EventRetention))
+		if err != nil {
+			common.ErrorLogger.Println(err)
+		} else if n > 0 {
+			common.InfoLogger.Printf("Pruned %d realtime events", n)
+		}
+		<-ticker.C
+	}
+}
+
+// sendError reports a failed action to the user.
+func (ws *WS) sendError(err error, sendTo string) {
+	p := errorPayload(err)
+	ws.sendOne(JsonResponse{Action: "error", Message: p.Message, Code: p.Code}, sendTo)
+}
+
+func (ws *WS) sendOne(response JsonResponse, sendTo string) {
+	ws.publish(eventSend, []string{sendTo}, &response)
+}
+
+// Stats reports the connections and delivery counters of the hub.
+func (ws *WS) Stats() HubStats {
+	return ws.hub.Stats()
 }
@@ -0,0 +1,16 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Placeholders returns n numbered placeholders from $first, separated by
+// commas, for an IN list.
+func Placeholders(first, n int) string {
+	ps := make([]string, n)
+	for i := range ps {
+		ps[i] = fmt.Sprintf("$%d", first+i)
+	}
+	return strings.Join(ps, ", ")
+}
@@ -0,0 +1,299 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"forum/internal/common"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProviderConfig describes one OpenID Connect identity provider.
+type ProviderConfig struct {
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+}
+
+type Config struct {
+	Providers []ProviderConfig `json:"providers"`
+}
+
+// LoadConfig reads the providers list from a JSON file. An empty path means
+// that external login is disabled.
+func LoadConfig(path string) (Config, error) {
+	var c Config
+	if path == "" {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, err
+	}
+	for _, p := range c.Providers {
+		if p.Name == "" || p.Issuer == "" || p.ClientID == "" || p.RedirectURL == "" {
+			return c, fmt.Errorf("oidc provider %q: name, issuer, client_id and redirect_url are required", p.Name)
+		}
+	}
+	return c, nil
+}
+
+// Claims are the ID token claims the forum uses.
+type Claims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	ExpiresAt         int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     bool     `json:"email_verified"`
+	PreferredUsername string   `json:"preferred_username"`
+	GivenName         string   `json:"given_name"`
+	FamilyName        string   `json:"family_name"`
+}
+
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider performs the authorization code flow with PKCE against a single
+// identity provider. Endpoints are discovered lazily on first use.
+type Provider struct {
+	cfg    ProviderConfig
+	client *http.Client
+
+	mu   sync.Mutex
+	meta *discovery
+	keys *keySet
+}
+
+func NewProvider(cfg ProviderConfig) *Provider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &Provider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *Provider) Name() string {
+	return p.cfg.Name
+}
+
+// AuthRequest holds the per-login secrets which have to survive the redirect
+// to the provider and back.
+type AuthRequest struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+func NewAuthRequest() (AuthRequest, error) {
+	state, err := randomString(32)
+	if err != nil {
+		return AuthRequest{}, err
+	}
+	nonce, err := randomString(32)
+	if err != nil {
+		return AuthRequest{}, err
+	}
+	verifier, err := randomString(48)
+	if err != nil {
+		return AuthRequest{}, err
+	}
+	return AuthRequest{State: state, Nonce: nonce, Verifier: verifier}, nil
+}
+
+// AuthURL builds the URL the browser is redirected to.
+func (p *Provider) AuthURL(req AuthRequest) (string, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(req.Verifier))
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.cfg.ClientID)
+	v.Set("redirect_uri", p.cfg.RedirectURL)
+	v.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	v.Set("state", req.State)
+	v.Set("nonce", req.Nonce)
+	v.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange trades the authorization code for tokens and returns the verified
+// claims of the ID token.
+func (p *Provider) Exchange(code string, req AuthRequest) (Claims, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return Claims{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+	form.Set("code_verifier", req.Verifier)
+	if p.cfg.ClientSecret != "" {
+		form.Set("client_secret", p.cfg.ClientSecret)
+	}
+
+	resp, err := p.client.PostForm(meta.TokenEndpoint, form)
+	if err != nil {
+		return Claims{}, common.NewAppError(err, "identity provider is unavailable", http.StatusBadGateway)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return Claims{}, common.InvalidArgumentError(fmt.Errorf("token endpoint: %s: %s", resp.Status, body), "cannot exchange authorization code")
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil || tokens.IDToken == "" {
+		return Claims{}, common.InvalidArgumentError(err, "identity provider returned no id token")
+	}
+
+	claims, err := p.verify(tokens.IDToken)
+	if err != nil {
+		return Claims{}, common.InvalidArgumentError(err, "id token is invalid")
+	}
+	if claims.Nonce != req.Nonce {
+		return Claims{}, common.InvalidArgumentError(nil, "id token nonce does not match")
+	}
+	return claims, nil
+}
+
+func (p *Provider) verify(raw string) (Claims, error) {
+	var claims Claims
+	keys, err := p.keySet()
+	if err != nil {
+		return claims, err
+	}
+	payload, err := keys.verify(raw)
+	if err != nil {
+		return claims, err
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, err
+	}
+
+	now := time.Now().Unix()
+	switch {
+	case claims.Issuer != p.cfg.Issuer:
+		return claims, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	case !claims.Audience.contains(p.cfg.ClientID):
+		return claims, errors.New("token is issued for another client")
+	case claims.ExpiresAt < now:
+		return claims, errors.New("token is expired")
+	case claims.Subject == "":
+		return claims, errors.New("token has no subject")
+	}
+	return claims, nil
+}
+
+func (p *Provider) discover() (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	var meta discovery
+	if err := p.getJSON(wellKnown, &meta); err != nil {
+		return nil, common.NewAppError(err, "identity provider is unavailable", http.StatusBadGateway)
+	}
+	if meta.Issuer != p.cfg.Issuer {
+		return nil, common.SystemError(fmt.Errorf("discovery issuer %q does not match %q", meta.Issuer, p.cfg.Issuer))
+	}
+	p.meta = &meta
+	return p.meta, nil
+}
+
+func (p *Provider) keySet() (*keySet, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.keys == nil {
+		p.keys = &keySet{fetch: func(v interface{}) error { return p.getJSON(meta.JWKSURI, v) }}
+	}
+	return p.keys, nil
+}
+
+func (p *Provider) getJSON(u string, v interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
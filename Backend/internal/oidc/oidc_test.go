@@ -0,0 +1,175 @@
+package oidc
+
+import (
+	"forum/internal/oidc/oidctest"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID = "forum"
+	testRedirect = "http://forum.test/oauth/callback"
+)
+
+func newTestProvider(t *testing.T) (*oidctest.Server, *Provider) {
+	t.Helper()
+	srv := oidctest.NewServer(testClientID)
+	t.Cleanup(srv.Close)
+	srv.SignIn(oidctest.Identity{Subject: "sub-1", Email: "ann@example.com", EmailVerified: true})
+	p := NewProvider(ProviderConfig{Name: "test", Issuer: srv.Issuer, ClientID: testClientID, RedirectURL: testRedirect})
+	return srv, p
+}
+
+// authorize sends the browser to the provider and returns the code and state
+// of the redirect back.
+func authorize(t *testing.T, p *Provider, req AuthRequest) (code, state string) {
+	t.Helper()
+	authURL, err := p.AuthURL(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: got status %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(back.String(), testRedirect) {
+		t.Fatalf("redirected to %s, want %s", back, testRedirect)
+	}
+	return back.Query().Get("code"), back.Query().Get("state")
+}
+
+func newAuthRequest(t *testing.T) AuthRequest {
+	t.Helper()
+	req, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestExchange(t *testing.T) {
+	_, p := newTestProvider(t)
+	req := newAuthRequest(t)
+
+	code, state := authorize(t, p, req)
+	if state != req.State {
+		t.Fatalf("state = %q, want %q", state, req.State)
+	}
+	claims, err := p.Exchange(code, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "sub-1" || claims.Email != "ann@example.com" || !claims.EmailVerified {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+	if claims.Nonce != req.Nonce {
+		t.Fatalf("nonce = %q, want %q", claims.Nonce, req.Nonce)
+	}
+}
+
+func TestExchangeChecksVerifier(t *testing.T) {
+	_, p := newTestProvider(t)
+	req := newAuthRequest(t)
+	code, _ := authorize(t, p, req)
+
+	// an intercepted code is of no use without the verifier
+	stolen := req
+	stolen.Verifier = newAuthRequest(t).Verifier
+	if _, err := p.Exchange(code, stolen); err == nil {
+		t.Fatal("exchange with another verifier succeeded")
+	}
+}
+
+func TestExchangeUsesCodeOnce(t *testing.T) {
+	_, p := newTestProvider(t)
+	req := newAuthRequest(t)
+	code, _ := authorize(t, p, req)
+
+	if _, err := p.Exchange(code, req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exchange(code, req); err == nil {
+		t.Fatal("code was exchanged twice")
+	}
+}
+
+func TestExchangeChecksNonce(t *testing.T) {
+	_, p := newTestProvider(t)
+
+	// the token of one login replayed into another one
+	first := newAuthRequest(t)
+	code, _ := authorize(t, p, first)
+	replayed := first
+	replayed.Nonce = newAuthRequest(t).Nonce
+	if _, err := p.Exchange(code, replayed); err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Fatalf("got error %v, want a nonce mismatch", err)
+	}
+}
+
+func TestExchangeRejectsInvalidTokens(t *testing.T) {
+	tests := []struct {
+		name  string
+		forge bool
+		edit  func(claims map[string]interface{})
+	}{
+		{name: "forged signature", forge: true},
+		{name: "other audience", edit: func(c map[string]interface{}) { c["aud"] = "another-client" }},
+		{name: "audience list without the client", edit: func(c map[string]interface{}) { c["aud"] = []string{"a", "b"} }},
+		{name: "other issuer", edit: func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }},
+		{name: "expired", edit: func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() }},
+		{name: "no subject", edit: func(c map[string]interface{}) { delete(c, "sub") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, p := newTestProvider(t)
+			srv.Forge(tt.forge)
+			srv.EditClaims(tt.edit)
+
+			req := newAuthRequest(t)
+			code, _ := authorize(t, p, req)
+			if _, err := p.Exchange(code, req); err == nil || !strings.Contains(err.Error(), "id token is invalid") {
+				t.Fatalf("got error %v, want an invalid id token", err)
+			}
+		})
+	}
+}
+
+func TestExchangeAcceptsAudienceList(t *testing.T) {
+	srv, p := newTestProvider(t)
+	srv.EditClaims(func(c map[string]interface{}) { c["aud"] = []string{"other", testClientID} })
+
+	req := newAuthRequest(t)
+	code, _ := authorize(t, p, req)
+	if _, err := p.Exchange(code, req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExchangeAfterKeyRotation(t *testing.T) {
+	srv, p := newTestProvider(t)
+	req := newAuthRequest(t)
+	code, _ := authorize(t, p, req)
+	if _, err := p.Exchange(code, req); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cached keys are refreshed for the unknown key id
+	srv.RotateKey()
+	req = newAuthRequest(t)
+	code, _ = authorize(t, p, req)
+	if _, err := p.Exchange(code, req); err != nil {
+		t.Fatal(err)
+	}
+}
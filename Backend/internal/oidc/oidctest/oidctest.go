@@ -0,0 +1,260 @@
+// Package oidctest implements a minimal OpenID Connect provider, for the tests
+// of the external login and for trying it locally.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Identity is the user who signs in at the provider.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Login         string
+	GivenName     string
+	FamilyName    string
+}
+
+// Provider is an identity provider with the authorization code flow and
+// PKCE. Its authorize endpoint approves every request at once for the signed
+// in user and redirects back with a code.
+type Provider struct {
+	Issuer   string
+	ClientID string
+
+	mux    *http.ServeMux
+	mu     sync.Mutex
+	user   Identity
+	key    *rsa.PrivateKey
+	kid    int
+	forge  bool
+	claims func(map[string]interface{})
+	codes  map[string]grant
+}
+
+type grant struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+	user        Identity
+}
+
+// NewProvider creates a provider which accepts the client.
+func NewProvider(issuer, clientID string) *Provider {
+	p := &Provider{Issuer: issuer, ClientID: clientID, codes: make(map[string]grant)}
+	p.RotateKey()
+
+	p.mux = http.NewServeMux()
+	p.mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	p.mux.HandleFunc("/authorize", p.authorize)
+	p.mux.HandleFunc("/token", p.token)
+	p.mux.HandleFunc("/jwks", p.jwks)
+	return p
+}
+
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mux.ServeHTTP(w, r)
+}
+
+// Server is a provider listening on a local port, with the issuer set to its
+// URL.
+type Server struct {
+	*httptest.Server
+	*Provider
+}
+
+// NewServer starts a provider which accepts the client.
+func NewServer(clientID string) *Server {
+	p := NewProvider("", clientID)
+	srv := httptest.NewServer(p)
+	p.Issuer = srv.URL
+	return &Server{Server: srv, Provider: p}
+}
+
+// SignIn sets the user of the next logins.
+func (p *Provider) SignIn(u Identity) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.user = u
+}
+
+// RotateKey replaces the signing key, under a new key id.
+func (p *Provider) RotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.key = key
+	p.kid++
+}
+
+// Forge makes the next ID tokens signed by a key the provider does not
+// publish, under the id of the published one.
+func (p *Provider) Forge(forge bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.forge = forge
+}
+
+// EditClaims sets a function which changes the claims of the next ID tokens
+// before they are signed. Nil issues the claims as they are.
+func (p *Provider) EditClaims(edit func(claims map[string]interface{})) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.claims = edit
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.Issuer,
+		"authorization_endpoint":                p.Issuer + "/authorize",
+		"token_endpoint":                        p.Issuer + "/token",
+		"jwks_uri":                              p.Issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != p.ClientID ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	code := randomString()
+	p.mu.Lock()
+	p.codes[code] = grant{
+		redirectURI: q.Get("redirect_uri"),
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		user:        p.user,
+	}
+	p.mu.Unlock()
+
+	v := redirect.Query()
+	v.Set("code", code)
+	v.Set("state", q.Get("state"))
+	redirect.RawQuery = v.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	g, ok := p.codes[code]
+	// codes are single use, whatever the outcome
+	delete(p.codes, code)
+	p.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code", !ok,
+		r.PostForm.Get("client_id") != p.ClientID, r.PostForm.Get("redirect_uri") != g.redirectURI:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	case base64.RawURLEncoding.EncodeToString(verifier[:]) != g.challenge:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "pkce verification failed"})
+		return
+	}
+
+	now := time.Now()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token": p.sign(map[string]interface{}{
+			"iss":                p.Issuer,
+			"sub":                g.user.Subject,
+			"aud":                p.ClientID,
+			"iat":                now.Unix(),
+			"exp":                now.Add(5 * time.Minute).Unix(),
+			"nonce":              g.nonce,
+			"email":              g.user.Email,
+			"email_verified":     g.user.EmailVerified,
+			"preferred_username": g.user.Login,
+			"given_name":         g.user.GivenName,
+			"family_name":        g.user.FamilyName,
+		}),
+	})
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	pub, kid := p.key.PublicKey, p.kid
+	p.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": fmt.Sprint(kid),
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// sign issues an RS256 JWT with the claims.
+func (p *Provider) sign(claims map[string]interface{}) string {
+	p.mu.Lock()
+	key, kid, forge, edit := p.key, p.kid, p.forge, p.claims
+	p.mu.Unlock()
+	if edit != nil {
+		edit(claims)
+	}
+	if forge {
+		var err error
+		if key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			panic(err)
+		}
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": fmt.Sprint(kid), "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	buf := make([]byte, 24)
+	_, _ = rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
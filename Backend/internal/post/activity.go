@@ -0,0 +1,182 @@
+package post
+
+import (
+	"fmt"
+	"forum/internal/common"
+	"forum/internal/user"
+	"time"
+)
+
+const (
+	defaultPageSize    = 20
+	maxPageSize        = 100
+	topCategoriesSize  = 3
+	recentActivitySize = 5
+)
+
+// UserStats summarises what a user wrote on the forum.
+type UserStats struct {
+	Posts            int             `json:"posts"`
+	Comments         int             `json:"comments"`
+	LikesReceived    int             `json:"likes_received"`
+	DislikesReceived int             `json:"dislikes_received"`
+	TopCategories    []CategoryCount `json:"top_categories"`
+	RecentActivity   []Activity      `json:"recent_activity"`
+}
+
+type CategoryCount struct {
+	Category
+	Posts int `json:"posts"`
+}
+
+// Activity is a post or a comment in the user's recent activity. For comments
+// Subject is the subject of the post they belong to.
+type Activity struct {
+	PostId    int       `json:"post_id"`
+	ParentId  int       `json:"parent_id,omitempty"`
+	IsComment bool      `json:"is_comment"`
+	Subject   string    `json:"subject"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type PostPage struct {
+	Posts   []PostAndMarks `json:"posts"`
+	Page    int            `json:"page"`
+	HasMore bool           `json:"has_more"`
+}
+
+func (s *Service) UserStats(userID string) (UserStats, error) {
+	var st UserStats
+	row := s.db.QueryRow(`SELECT coalesce(sum(case when parent_id is null then 1 else 0 end), 0),
+       coalesce(sum(case when parent_id is not null then 1 else 0 end), 0)
+FROM posts
+WHERE user_id = $1`, userID)
+	if err := row.Scan(&st.Posts, &st.Comments); err != nil {
+		return UserStats{}, common.DataBaseError(err)
+	}
+
+	row = s.db.QueryRow(`SELECT coalesce(sum(case when ld.mark then 1 else 0 end), 0),
+       coalesce(sum(case when not ld.mark then 1 else 0 end), 0)
+FROM likes_dislikes ld
+         JOIN posts p ON p.id = ld.post_id
+WHERE p.user_id = $1 AND ld.user_id <> $1`, userID)
+	if err := row.Scan(&st.LikesReceived, &st.DislikesReceived); err != nil {
+		return UserStats{}, common.DataBaseError(err)
+	}
+
+	rows, err := s.db.Query(`SELECT c.id, c.name, count(*) AS n
+FROM posts p
+         JOIN posts_categories pc ON pc.post_id = p.id
+         JOIN categories c ON c.id = pc.category_id
+WHERE p.user_id = $1
+GROUP BY c.id
+ORDER BY n DESC, c.name
+LIMIT $2`, userID, topCategoriesSize)
+	if err != nil {
+		return UserStats{}, common.DataBaseError(err)
+	}
+	defer rows.Close()
+	st.TopCategories = make([]CategoryCount, 0, topCategoriesSize)
+	for rows.Next() {
+		var c CategoryCount
+		if err := rows.Scan(&c.Id, &c.Name, &c.Posts); err != nil {
+			return UserStats{}, common.DataBaseError(err)
+		}
+		st.TopCategories = append(st.TopCategories, c)
+	}
+	if err := rows.Err(); err != nil {
+		return UserStats{}, common.DataBaseError(err)
+	}
+
+	rows, err = s.db.Query(`SELECT p.id, coalesce(p.parent_id, 0), coalesce(root.subject, p.subject), p.created_at
+FROM posts p
+         LEFT JOIN posts root ON root.id = p.parent_id
+WHERE p.user_id = $1
+ORDER BY p.created_at DESC, p.id DESC
+LIMIT $2`, userID, recentActivitySize)
+	if err != nil {
+		return UserStats{}, common.DataBaseError(err)
+	}
+	defer rows.Close()
+	st.RecentActivity = make([]Activity, 0, recentActivitySize)
+	for rows.Next() {
+		var a Activity
+		if err := rows.Scan(&a.PostId, &a.ParentId, &a.Subject, &a.CreatedAt); err != nil {
+			return UserStats{}, common.DataBaseError(err)
+		}
+		a.IsComment = a.ParentId != 0
+		st.RecentActivity = append(st.RecentActivity, a)
+	}
+	if err := rows.Err(); err != nil {
+		return UserStats{}, common.DataBaseError(err)
+	}
+	return st, nil
+}
+
+// UserPosts returns a page of the user's posts, or of the user's comments,
+// newest first.
+func (s *Service) UserPosts(userID string, comments bool, page, limit int) (PostPage, error) {
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		return PostPage{}, common.InvalidArgumentError(nil, fmt.Sprintf("limit must not exceed %d", maxPageSize))
+	}
+	if page < 1 {
+		page = 1
+	}
+	kind := "p.parent_id is null"
+	if comments {
+		kind = "p.parent_id is not null"
+	}
+
+	query := fmt.Sprintf(`SELECT p.id,
+       p.user_id,
+       u.login,
+       p.content,
+       p.subject,
+       p.created_at,
+       COALESCE(p.parent_id, 0)                    as parent_id,
+       coalesce(dislike, 0)                        as dislike,
+       coalesce(like, 0)                           as like,
+       coalesce(group_concat(distinct c.name), '') as category_name
+FROM posts p
+         LEFT JOIN (
+    Select post_id,
+           sum(case when not mark then 1 else 0 end) AS dislike,
+           sum(case when mark then 1 else 0 end)     AS like
+    FROM likes_dislikes
+    group by post_id
+) as ld ON p.id = ld.post_id
+         LEFT JOIN posts_categories pc on p.id = pc.post_id
+         LEFT JOIN categories c on c.id = pc.category_id
+         INNER JOIN users u on u.id = p.user_id
+WHERE u.id = $1 AND %s
+group by p.id
+ORDER BY p.created_at desc, p.id desc
+LIMIT %d OFFSET %d`, kind, limit+1, (page-1)*limit)
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return PostPage{}, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	res := PostPage{Posts: make([]PostAndMarks, 0, limit), Page: page}
+	for rows.Next() {
+		var p PostAndMarks
+		err := rows.Scan(&p.Id, &p.UserId, &p.UserLogin, &p.Content, &p.Subject, &p.CreatedAt, &p.ParentId, &p.Dislikes, &p.Likes, &p.Categories)
+		if err != nil {
+			return PostPage{}, common.DataBaseError(err)
+		}
+		if len(res.Posts) == limit {
+			res.HasMore = true
+			break
+		}
+		p.UserAvatar = user.AvatarURL(p.UserId)
+		res.Posts = append(res.Posts, p)
+	}
+	if err := rows.Err(); err != nil {
+		return PostPage{}, common.DataBaseError(err)
+	}
+	return res, nil
+}
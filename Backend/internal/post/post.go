@@ -22,12 +22,31 @@ type Mark struct {
 type PostAndMarks struct {
 	Post
 	UserLogin  string `json:"user_login,omitempty"`
+	UserAvatar string `json:"user_avatar,omitempty"`
 	Likes      int    `json:"likes,omitempty"`
 	Dislikes   int    `json:"dislikes,omitempty"`
 	Categories string `json:"categories,omitempty"`
+	Collapsed  bool   `json:"collapsed,omitempty"`
+}
+
+// Collapse marks the posts and comments written by the given authors.
+func Collapse(posts []PostAndMarks, authors map[string]bool) {
+	if len(authors) == 0 {
+		return
+	}
+	for i := range posts {
+		posts[i].Collapsed = authors[posts[i].UserId]
+		Collapse(posts[i].Comments, authors)
+	}
 }
 
 type Category struct {
 	Id   int    `json:"id"`
 	Name string `json:"name"`
 }
+
+// UserMark is a like or dislike as seen from the user who set it.
+type UserMark struct {
+	PostId int  `json:"post_id"`
+	Like   bool `json:"like"`
+}
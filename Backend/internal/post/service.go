@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"forum/internal/common"
+	"forum/internal/user"
 	"log"
+	"strconv"
 	"strings"
 )
 
@@ -128,6 +130,7 @@ group by p.id`)
 			common.InfoLogger.Println(err)
 			continue
 		}
+		p.UserAvatar = user.AvatarURL(p.UserId)
 		posts = append(posts, p)
 	}
 	return posts, nil
@@ -245,6 +248,7 @@ FROM posts p
 			common.ErrorLogger.Println(err)
 			continue
 		}
+		post.UserAvatar = user.AvatarURL(post.UserId)
 		posts = append(posts, post)
 	}
 	return posts, nil
@@ -280,7 +284,7 @@ ORDER BY p.created_at desc`)
 		return nil, common.SystemError(err)
 	}
 	defer rows.Close()
-	var posts []PostAndMarks
+	posts := []PostAndMarks{}
 	for rows.Next() {
 		var post PostAndMarks
 		err := rows.Scan(&post.Id, &post.UserId, &post.UserLogin, &post.Content, &post.Subject, &post.CreatedAt, &post.ParentId, &post.Dislikes, &post.Likes, &post.Categories)
@@ -288,12 +292,9 @@ ORDER BY p.created_at desc`)
 			common.ErrorLogger.Println(err)
 			continue
 		}
+		post.UserAvatar = user.AvatarURL(post.UserId)
 		posts = append(posts, post)
 	}
-
-	if len(posts) == 0 {
-		return nil, common.InvalidArgumentError(nil, "user has no posts")
-	}
 	return posts, nil
 }
 
@@ -336,6 +337,7 @@ ORDER BY p.created_at desc`
 			common.ErrorLogger.Println(err)
 			continue
 		}
+		post.UserAvatar = user.AvatarURL(post.UserId)
 		posts = append(posts, post)
 	}
 	return posts, nil
@@ -392,6 +394,7 @@ WHERE p.id =$1`
 	if err != nil {
 		return PostAndMarks{}, common.NotFoundError(err, "cannot find post")
 	}
+	post.UserAvatar = user.AvatarURL(post.UserId)
 	//post.Comments, err = s.CommentsByPostId(post)
 	//if err != nil {
 	//	common.ErrorLogger.Println(err)
@@ -461,6 +464,7 @@ group by cte.id`)
 			common.WarningLogger.Println(err)
 			continue
 		}
+		p.UserAvatar = user.AvatarURL(p.UserId)
 		comments = append(comments, p)
 	}
 	return comments, nil
@@ -476,3 +480,56 @@ func addNestedChild(m map[int][]PostAndMarks, post *PostAndMarks) {
 		addNestedChild(m, &post.Comments[i])
 	}
 }
+
+// PostsOfUser returns every post and comment of the user, oldest first.
+func (s *Service) PostsOfUser(userID string) ([]Post, error) {
+	rows, err := s.db.Query(`SELECT p.id, p.content, p.subject, p.created_at, coalesce(p.parent_id, 0), coalesce(group_concat(pc.category_id), '')
+FROM posts p
+         LEFT JOIN posts_categories pc on p.id = pc.post_id
+WHERE p.user_id = $1
+group by p.id
+ORDER BY p.created_at`, userID)
+	if err != nil {
+		return nil, common.SystemError(err)
+	}
+	defer rows.Close()
+
+	posts := []Post{}
+	for rows.Next() {
+		var (
+			p    Post
+			cats string
+		)
+		if err := rows.Scan(&p.Id, &p.Content, &p.Subject, &p.CreatedAt, &p.ParentId, &cats); err != nil {
+			common.ErrorLogger.Println(err)
+			continue
+		}
+		p.UserId = userID
+		for _, c := range strings.Split(cats, ",") {
+			if id, err := strconv.Atoi(c); err == nil {
+				p.Categories = append(p.Categories, id)
+			}
+		}
+		posts = append(posts, p)
+	}
+	return posts, nil
+}
+
+func (s *Service) MarksOfUser(userID string) ([]UserMark, error) {
+	rows, err := s.db.Query(`SELECT post_id, mark FROM likes_dislikes WHERE user_id=$1 ORDER BY post_id`, userID)
+	if err != nil {
+		return nil, common.SystemError(err)
+	}
+	defer rows.Close()
+
+	marks := []UserMark{}
+	for rows.Next() {
+		var m UserMark
+		if err := rows.Scan(&m.PostId, &m.Like); err != nil {
+			common.ErrorLogger.Println(err)
+			continue
+		}
+		marks = append(marks, m)
+	}
+	return marks, nil
+}
@@ -0,0 +1,161 @@
+package user
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"forum/internal/common"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	AvatarSize       = 128
+	MaxAvatarBytes   = 5 << 20
+	maxAvatarPixels  = 4096 * 4096
+	identiconCells   = 5
+	identiconPadding = 8
+)
+
+// AvatarURL is where the avatar of the user is served.
+func AvatarURL(userID string) string {
+	return "/avatar?id=" + userID
+}
+
+// SetAvatar decodes the uploaded image, crops it to a square, scales it down
+// to AvatarSize and stores it as PNG.
+func (s *Service) SetAvatar(userID string, r io.Reader) error {
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxAvatarBytes+1))
+	if err != nil {
+		return common.InvalidArgumentError(err, "cannot read image")
+	}
+	if len(data) > MaxAvatarBytes {
+		return common.InvalidArgumentError(nil, "image is too large")
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return common.InvalidArgumentError(err, "unsupported image format")
+	}
+	if cfg.Width*cfg.Height > maxAvatarPixels {
+		return common.InvalidArgumentError(nil, "image dimensions are too large")
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return common.InvalidArgumentError(err, "unsupported image format")
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, resizeSquare(img, AvatarSize)); err != nil {
+		return common.SystemError(err)
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO avatars (user_id, image, updated_at) VALUES ($1, $2, $3)`, userID, buf.Bytes(), time.Now())
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	return nil
+}
+
+func (s *Service) DeleteAvatar(userID string) error {
+	if _, err := s.db.Exec(`DELETE FROM avatars WHERE user_id=$1`, userID); err != nil {
+		return common.DataBaseError(err)
+	}
+	return nil
+}
+
+// Avatar returns the PNG avatar of the user. Users without an uploaded avatar
+// get a generated identicon.
+func (s *Service) Avatar(userID string) ([]byte, time.Time, error) {
+	row := s.db.QueryRow(`SELECT image, updated_at FROM avatars WHERE user_id=$1`, userID)
+	var (
+		data      []byte
+		updatedAt time.Time
+	)
+	err := row.Scan(&data, &updatedAt)
+	if err == nil {
+		return data, updatedAt, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, time.Time{}, common.DataBaseError(err)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, identicon(userID)); err != nil {
+		return nil, time.Time{}, common.SystemError(err)
+	}
+	return buf.Bytes(), time.Time{}, nil
+}
+
+// resizeSquare crops the centre square of the image and scales it to size x size
+// by averaging the source pixels which fall into every target pixel.
+func resizeSquare(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		sy0 := y0 + y*side/size
+		sy1 := y0 + (y+1)*side/size
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < size; x++ {
+			sx0 := x0 + x*side/size
+			sx1 := x0 + (x+1)*side/size
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// identicon draws a symmetric 5x5 pattern derived from the user id.
+func identicon(userID string) image.Image {
+	sum := sha256.Sum256([]byte(userID))
+	fg := color.RGBA{R: sum[0], G: sum[1], B: sum[2], A: 0xff}
+	bg := color.RGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff}
+
+	img := image.NewRGBA(image.Rect(0, 0, AvatarSize, AvatarSize))
+	cell := (AvatarSize - 2*identiconPadding) / identiconCells
+	for y := 0; y < AvatarSize; y++ {
+		for x := 0; x < AvatarSize; x++ {
+			img.Set(x, y, bg)
+		}
+	}
+	for row := 0; row < identiconCells; row++ {
+		for col := 0; col < (identiconCells+1)/2; col++ {
+			if sum[3+row*3+col]%2 == 0 {
+				continue
+			}
+			for _, c := range []int{col, identiconCells - 1 - col} {
+				for y := 0; y < cell; y++ {
+					for x := 0; x < cell; x++ {
+						img.Set(identiconPadding+c*cell+x, identiconPadding+row*cell+y, fg)
+					}
+				}
+			}
+		}
+	}
+	return img
+}
@@ -0,0 +1,149 @@
+package user
+
+import (
+	"database/sql"
+	"errors"
+	"forum/internal/common"
+	"net/http"
+	"time"
+)
+
+// ErrBlocked is returned when the receiver has blocked the sender.
+var ErrBlocked = common.NewAppError(nil, "you cannot send messages to this user, they have blocked you", http.StatusForbidden)
+
+// BlockedUser is an entry of the user's block list. With CollapseContent the
+// posts and comments of the blocked user are collapsed in listings.
+type BlockedUser struct {
+	UserID          string    `json:"user_id"`
+	Login           string    `json:"login"`
+	CollapseContent bool      `json:"collapse_content"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+func (s *Service) BlockUser(blockerID, credential string, collapse bool) (BlockedUser, error) {
+	u, err := s.FindByCredential(credential)
+	if err != nil {
+		return BlockedUser{}, err
+	}
+	if u.ID == blockerID {
+		return BlockedUser{}, common.InvalidArgumentError(nil, "you cannot block yourself")
+	}
+	if u.ID == DeletedUserID {
+		return BlockedUser{}, common.NotFoundError(nil, "user not found")
+	}
+	b := BlockedUser{UserID: u.ID, Login: u.Login, CollapseContent: collapse, CreatedAt: time.Now()}
+	_, err = s.db.Exec(`INSERT INTO user_blocks (blocker_id, blocked_id, collapse_content, created_at) VALUES ($1, $2, $3, $4)
+ON CONFLICT (blocker_id, blocked_id) DO UPDATE SET collapse_content=excluded.collapse_content`,
+		blockerID, b.UserID, b.CollapseContent, b.CreatedAt)
+	if err != nil {
+		return BlockedUser{}, common.DataBaseError(err)
+	}
+	return b, nil
+}
+
+func (s *Service) UnblockUser(blockerID, credential string) error {
+	u, err := s.FindByCredential(credential)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`DELETE FROM user_blocks WHERE blocker_id=$1 AND blocked_id=$2`, blockerID, u.ID)
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return common.NotFoundError(nil, "this user is not blocked")
+	}
+	return nil
+}
+
+func (s *Service) BlockedUsers(blockerID string) ([]BlockedUser, error) {
+	rows, err := s.db.Query(`SELECT b.blocked_id, u.login, b.collapse_content, b.created_at
+FROM user_blocks b
+         JOIN users u ON u.id = b.blocked_id
+WHERE b.blocker_id = $1
+ORDER BY u.login COLLATE NOCASE`, blockerID)
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	blocked := make([]BlockedUser, 0)
+	for rows.Next() {
+		var b BlockedUser
+		if err := rows.Scan(&b.UserID, &b.Login, &b.CollapseContent, &b.CreatedAt); err != nil {
+			return nil, common.DataBaseError(err)
+		}
+		blocked = append(blocked, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	return blocked, nil
+}
+
+// IsBlocked reports whether blockerID has blocked userID.
+func (s *Service) IsBlocked(blockerID, userID string) (bool, error) {
+	var one int
+	err := s.db.QueryRow(`SELECT 1 FROM user_blocks WHERE blocker_id=$1 AND blocked_id=$2`, blockerID, userID).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, common.DataBaseError(err)
+	}
+	return true, nil
+}
+
+// BlockedByEach returns the IDs of the users blocked by each of the blockers.
+func (s *Service) BlockedByEach(blockerIDs []string) (map[string]map[string]bool, error) {
+	blocked := make(map[string]map[string]bool)
+	if len(blockerIDs) == 0 {
+		return blocked, nil
+	}
+	args := make([]interface{}, len(blockerIDs))
+	for i, id := range blockerIDs {
+		args[i] = id
+	}
+	rows, err := s.db.Query(`SELECT blocker_id, blocked_id FROM user_blocks WHERE blocker_id IN (`+
+		common.Placeholders(1, len(args))+`)`, args...)
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var blocker, id string
+		if err := rows.Scan(&blocker, &id); err != nil {
+			return nil, common.DataBaseError(err)
+		}
+		if blocked[blocker] == nil {
+			blocked[blocker] = make(map[string]bool)
+		}
+		blocked[blocker][id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	return blocked, nil
+}
+
+// CollapsedAuthors returns the users whose content the viewer wants collapsed.
+func (s *Service) CollapsedAuthors(viewerID string) (map[string]bool, error) {
+	authors := make(map[string]bool)
+	if viewerID == "" {
+		return authors, nil
+	}
+	rows, err := s.db.Query(`SELECT blocked_id FROM user_blocks WHERE blocker_id=$1 AND collapse_content`, viewerID)
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, common.DataBaseError(err)
+		}
+		authors[id] = true
+	}
+	return authors, rows.Err()
+}
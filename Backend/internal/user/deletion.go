@@ -0,0 +1,203 @@
+package user
+
+import (
+	"database/sql"
+	"errors"
+	"forum/internal/common"
+	"time"
+)
+
+// DeletedUserID is the placeholder account which takes over the posts of
+// erased users, so that discussions stay readable.
+const DeletedUserID = "00000000-0000-0000-0000-000000000000"
+
+// DMPolicy decides what happens to direct messages of an erased account.
+type DMPolicy string
+
+const (
+	// DMDelete removes every message the user sent or received.
+	DMDelete DMPolicy = "delete"
+	// DMAnonymise keeps the messages for the other participant but moves them
+	// to the placeholder account.
+	DMAnonymise DMPolicy = "anonymise"
+)
+
+func (p DMPolicy) IsValid() bool {
+	return p == DMDelete || p == DMAnonymise
+}
+
+type DeletionPolicy struct {
+	GracePeriod time.Duration
+	DM          DMPolicy
+}
+
+var DefaultDeletionPolicy = DeletionPolicy{
+	GracePeriod: 14 * 24 * time.Hour,
+	DM:          DMDelete,
+}
+
+func (s *Service) SetDeletionPolicy(p DeletionPolicy) {
+	s.deletion = p
+}
+
+// RequestDeletion schedules the account for erasure after the grace period and
+// ends all of its sessions and tokens. Logging in again within the grace period
+// allows the user to cancel.
+func (s *Service) RequestDeletion(userID, pwd string) (time.Time, error) {
+	u, err := s.FindByCredential(userID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if u.ID == DeletedUserID {
+		return time.Time{}, common.ForbiddenError
+	}
+	if !u.comparePassword(u.Password, pwd) {
+		return time.Time{}, common.InvalidArgumentError(nil, "password is incorrect")
+	}
+
+	eraseAfter := time.Now().Add(s.deletion.GracePeriod)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return time.Time{}, common.DataBaseError(err)
+	}
+	queries := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`INSERT OR REPLACE INTO account_deletions (user_id, requested_at, erase_after) VALUES ($1, $2, $3)`, []interface{}{u.ID, time.Now(), eraseAfter}},
+		{`DELETE FROM sessions WHERE user_id=$1`, []interface{}{u.ID}},
+		{`DELETE FROM api_tokens WHERE user_id=$1`, []interface{}{u.ID}},
+	}
+	for _, q := range queries {
+		if _, err := tx.Exec(q.query, q.args...); err != nil {
+			_ = tx.Rollback()
+			return time.Time{}, common.DataBaseError(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return time.Time{}, common.DataBaseError(err)
+	}
+	return eraseAfter, nil
+}
+
+func (s *Service) CancelDeletion(userID string) error {
+	res, err := s.db.Exec(`DELETE FROM account_deletions WHERE user_id=$1`, userID)
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return common.NotFoundError(nil, "account is not scheduled for deletion")
+	}
+	return nil
+}
+
+// ScheduledDeletion returns when the account will be erased, or nil.
+func (s *Service) ScheduledDeletion(userID string) (*time.Time, error) {
+	row := s.db.QueryRow(`SELECT erase_after FROM account_deletions WHERE user_id=$1`, userID)
+	var t time.Time
+	if err := row.Scan(&t); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, common.DataBaseError(err)
+	}
+	return &t, nil
+}
+
+// EraseExpiredAccounts erases every account whose grace period is over and
+// returns the logins of the erased ones.
+func (s *Service) EraseExpiredAccounts() ([]string, error) {
+	rows, err := s.db.Query(`SELECT user_id FROM account_deletions WHERE erase_after <= $1`, time.Now())
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			common.InfoLogger.Println(err)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	var erased []string
+	for _, id := range ids {
+		login, err := s.eraseAccount(id)
+		if err != nil {
+			common.ErrorLogger.Printf("cannot erase account %s: %v", id, err)
+			continue
+		}
+		erased = append(erased, login)
+	}
+	return erased, nil
+}
+
+// ownerHandover hands the groups owned by the user over to their next member,
+// as leaving them does, and deletes those left without members.
+var ownerHandover = []string{
+	`DELETE FROM conversations
+WHERE kind='group'
+  AND id IN (SELECT conversation_id FROM conversation_members WHERE user_id=$1 AND role='owner')
+  AND NOT EXISTS (SELECT 1 FROM conversation_members m WHERE m.conversation_id=conversations.id AND m.user_id<>$1)`,
+	`UPDATE conversation_members SET role='owner'
+WHERE conversation_id IN (SELECT o.conversation_id
+                          FROM conversation_members o
+                                   JOIN conversations c ON c.id = o.conversation_id
+                          WHERE o.user_id=$1 AND o.role='owner' AND c.kind='group')
+  AND user_id = (SELECT n.user_id
+                 FROM conversation_members n
+                          JOIN users u ON u.id = n.user_id
+                 WHERE n.conversation_id=conversation_members.conversation_id AND n.user_id<>$1
+                 ORDER BY n.joined_at, u.login
+                 LIMIT 1)`,
+}
+
+// eraseAccount removes the user for good and returns its login. Posts,
+// comments and messages in conversations are kept under the placeholder
+// account, marks are removed and direct messages are handled according to the
+// policy. Owned groups are handed over. Everything else is removed by
+// cascading deletes.
+func (s *Service) eraseAccount(userID string) (string, error) {
+	queries := []string{
+		`UPDATE posts SET user_id='` + DeletedUserID + `' WHERE user_id=$1`,
+		`DELETE FROM likes_dislikes WHERE user_id=$1`,
+		`DELETE FROM online_status WHERE user_id=$1`,
+		`DELETE FROM presence_connections WHERE user_id=$1`,
+		// the client ids of moved messages could clash with those of other
+		// erased users
+		`UPDATE chat SET msg_from='` + DeletedUserID + `', client_id=NULL WHERE msg_from=$1 AND conversation_id IS NOT NULL`,
+	}
+	queries = append(queries, ownerHandover...)
+	switch s.deletion.DM {
+	case DMAnonymise:
+		queries = append(queries,
+			`UPDATE chat SET msg_from='`+DeletedUserID+`', client_id=NULL WHERE msg_from=$1`,
+			`UPDATE chat SET msg_to='`+DeletedUserID+`' WHERE msg_to=$1`)
+	default:
+		queries = append(queries, `DELETE FROM chat WHERE (msg_from=$1 OR msg_to=$1) AND conversation_id IS NULL`)
+	}
+	queries = append(queries, `DELETE FROM users WHERE id=$1`)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", common.DataBaseError(err)
+	}
+	var login string
+	if err := tx.QueryRow(`SELECT login FROM users WHERE id=$1`, userID).Scan(&login); err != nil {
+		_ = tx.Rollback()
+		return "", common.DataBaseError(err)
+	}
+	for _, q := range queries {
+		if _, err := tx.Exec(q, userID); err != nil {
+			_ = tx.Rollback()
+			return "", common.DataBaseError(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", common.DataBaseError(err)
+	}
+	common.InfoLogger.Printf("Account %s erased", userID)
+	return login, nil
+}
@@ -0,0 +1,163 @@
+package user
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"forum/internal/common"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDirectoryPageSize = 20
+	maxDirectoryPageSize     = 100
+)
+
+// Privacy controls what other users see about the user. Unlisted users do not
+// appear in the directory or in search results.
+type Privacy struct {
+	Listed     bool `json:"listed"`
+	ShowName   bool `json:"show_name"`
+	ShowAge    bool `json:"show_age"`
+	ShowGender bool `json:"show_gender"`
+}
+
+var DefaultPrivacy = Privacy{Listed: true, ShowName: true}
+
+// PublicUser holds the fields of a user which can be shown to anyone, limited
+// by the user's privacy settings. It never contains the email.
+type PublicUser struct {
+	ID        string    `json:"id"`
+	Login     string    `json:"login"`
+	FirstName string    `json:"first_name,omitempty"`
+	LastName  string    `json:"last_name,omitempty"`
+	Age       uint      `json:"age,omitempty"`
+	Gender    string    `json:"gender,omitempty"`
+	Role      Role      `json:"role"`
+	Avatar    string    `json:"avatar"`
+	JoinedAt  time.Time `json:"joined_at"`
+}
+
+type DirectoryPage struct {
+	Users   []PublicUser `json:"users"`
+	Page    int          `json:"page"`
+	HasMore bool         `json:"has_more"`
+}
+
+func (s *Service) Privacy(userID string) (Privacy, error) {
+	p := DefaultPrivacy
+	row := s.db.QueryRow(`SELECT listed, show_name, show_age, show_gender FROM user_privacy WHERE user_id=$1`, userID)
+	if err := row.Scan(&p.Listed, &p.ShowName, &p.ShowAge, &p.ShowGender); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Privacy{}, common.DataBaseError(err)
+	}
+	return p, nil
+}
+
+func (s *Service) SetPrivacy(userID string, p Privacy) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO user_privacy (user_id, listed, show_name, show_age, show_gender) VALUES ($1, $2, $3, $4, $5)`,
+		userID, p.Listed, p.ShowName, p.ShowAge, p.ShowGender)
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	return nil
+}
+
+func (u User) public(p Privacy) PublicUser {
+	pu := PublicUser{ID: u.ID, Login: u.Login, Role: u.Role, Avatar: AvatarURL(u.ID), JoinedAt: u.CreatedAt}
+	if p.ShowName {
+		pu.FirstName, pu.LastName = u.FirstName, u.LastName
+	}
+	if p.ShowAge {
+		pu.Age = u.Age
+	}
+	if p.ShowGender {
+		pu.Gender = u.Gender.String()
+	}
+	return pu
+}
+
+// Directory lists the listed users by login. With a query only users whose
+// login, or visible first or last name, starts with it are returned.
+func (s *Service) Directory(query string, page, limit int) (DirectoryPage, error) {
+	if limit <= 0 {
+		limit = defaultDirectoryPageSize
+	}
+	if limit > maxDirectoryPageSize {
+		return DirectoryPage{}, common.InvalidArgumentError(nil, fmt.Sprintf("limit must not exceed %d", maxDirectoryPageSize))
+	}
+	if page < 1 {
+		page = 1
+	}
+
+	where := ""
+	args := []interface{}{DeletedUserID}
+	if query = strings.TrimSpace(query); query != "" {
+		args = append(args, likePrefix(query))
+		where = ` AND (u.login LIKE $2 ESCAPE '\' OR coalesce(p.show_name, true) AND (u.first_name LIKE $2 ESCAPE '\' OR u.last_name LIKE $2 ESCAPE '\'))`
+	}
+	rows, err := s.db.Query(fmt.Sprintf(`SELECT u.id, u.login, u.age, u.gender, u.first_name, u.last_name, u.role, u.created_at,
+       coalesce(p.show_name, true), coalesce(p.show_age, false), coalesce(p.show_gender, false)
+FROM users u
+         LEFT JOIN user_privacy p ON p.user_id = u.id
+WHERE u.id <> $1
+  AND coalesce(p.listed, true)
+  AND u.id NOT IN (SELECT user_id FROM account_deletions)%s
+ORDER BY u.login COLLATE NOCASE
+LIMIT %d OFFSET %d`, where, limit+1, (page-1)*limit), args...)
+	if err != nil {
+		return DirectoryPage{}, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	res := DirectoryPage{Users: make([]PublicUser, 0, limit), Page: page}
+	for rows.Next() {
+		var (
+			u User
+			p = Privacy{Listed: true}
+		)
+		if err := rows.Scan(&u.ID, &u.Login, &u.Age, &u.Gender, &u.FirstName, &u.LastName, &u.Role, &u.CreatedAt,
+			&p.ShowName, &p.ShowAge, &p.ShowGender); err != nil {
+			return DirectoryPage{}, common.DataBaseError(err)
+		}
+		if len(res.Users) == limit {
+			res.HasMore = true
+			break
+		}
+		res.Users = append(res.Users, u.public(p))
+	}
+	if err := rows.Err(); err != nil {
+		return DirectoryPage{}, common.DataBaseError(err)
+	}
+	return res, nil
+}
+
+// likePrefix escapes the LIKE wildcards in the query and turns it into a
+// prefix pattern.
+func likePrefix(query string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(query) + "%"
+}
+
+// PublicProfile returns the public view of the user with the login. Accounts
+// scheduled for deletion are not shown.
+func (s *Service) PublicProfile(login string) (PublicUser, error) {
+	var id string
+	err := s.db.QueryRow(`SELECT id FROM users WHERE login=$1 AND id<>$2 AND id NOT IN (SELECT user_id FROM account_deletions)`,
+		login, DeletedUserID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PublicUser{}, common.NotFoundError(nil, "cannot find user with this login")
+	}
+	if err != nil {
+		return PublicUser{}, common.DataBaseError(err)
+	}
+	u, err := s.FindByCredential(id)
+	if err != nil {
+		return PublicUser{}, err
+	}
+	p, err := s.Privacy(u.ID)
+	if err != nil {
+		return PublicUser{}, err
+	}
+	return u.public(p), nil
+}
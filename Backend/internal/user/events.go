@@ -0,0 +1,52 @@
+package user
+
+import (
+	"forum/internal/common"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventLoginFailed      EventType = "login_failed"
+	EventRepeatedFailures EventType = "repeated_login_failures"
+	EventAccountLocked    EventType = "account_locked"
+	EventAccountUnlocked  EventType = "account_unlocked"
+)
+
+// SecurityEvent reports something security relevant which happened to an
+// account. UserID is empty when the login did not match any user; ActorID is
+// set when someone else acted on the account.
+type SecurityEvent struct {
+	Type      EventType
+	UserID    string
+	Login     string
+	ActorID   string
+	IP        string
+	UserAgent string
+	Time      time.Time
+	Details   string
+}
+
+// Client describes where a request came from.
+type Client struct {
+	IP        string
+	UserAgent string
+}
+
+func logEvent(e SecurityEvent) {
+	common.WarningLogger.Printf("security event %s: user=%q login=%q actor=%q ip=%s %s", e.Type, e.UserID, e.Login, e.ActorID, e.IP, e.Details)
+}
+
+// SetEventHandler replaces the function which receives security events. By
+// default they are written to the log.
+func (s *Service) SetEventHandler(h func(SecurityEvent)) {
+	s.onEvent = h
+}
+
+func (s *Service) emit(e SecurityEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	s.onEvent(e)
+}
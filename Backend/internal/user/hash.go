@@ -0,0 +1,229 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"forum/internal/common"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"sort"
+	"strings"
+)
+
+type HashAlgorithm string
+
+const (
+	HashArgon2id HashAlgorithm = "argon2id"
+	HashBcrypt   HashAlgorithm = "bcrypt"
+)
+
+func (a HashAlgorithm) IsValid() bool {
+	return a == HashArgon2id || a == HashBcrypt
+}
+
+// HashParams select the algorithm new password hashes are created with.
+// Hashes are stored in the PHC string format ($argon2id$v=19$m=...,t=...,p=...$salt$key)
+// or the usual bcrypt format ($2a$cost$...), so the parameters of every stored
+// hash are known and outdated ones can be upgraded on login.
+type HashParams struct {
+	Algorithm  HashAlgorithm
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+var DefaultHashParams = HashParams{
+	Algorithm:  HashArgon2id,
+	BcryptCost: 12,
+	Argon2: Argon2Params{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 2,
+		KeyLen:  32,
+		SaltLen: 16,
+	},
+}
+
+func (s *Service) SetHashParams(p HashParams) {
+	s.hashParams = p
+}
+
+func (s *Service) hashPassword(u *User) error {
+	hash, err := s.hashParams.hash(u.Password)
+	if err != nil {
+		return common.SystemError(err)
+	}
+	u.Password = hash
+	return nil
+}
+
+func (p HashParams) hash(pwd string) (string, error) {
+	if p.Algorithm == HashBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(pwd), p.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+
+	a := p.Argon2
+	salt := make([]byte, a.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(pwd), salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// parsedHash is a stored hash split into its parameters.
+type parsedHash struct {
+	algorithm HashAlgorithm
+	cost      int
+	argon2    Argon2Params
+	salt, key []byte
+}
+
+func parseHash(hash string) (parsedHash, bool) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+		xs := strings.Split(hash, "$")
+		if len(xs) != 6 {
+			return parsedHash{}, false
+		}
+		var version int
+		if _, err := fmt.Sscanf(xs[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return parsedHash{}, false
+		}
+		h := parsedHash{algorithm: HashArgon2id}
+		if _, err := fmt.Sscanf(xs[3], "m=%d,t=%d,p=%d", &h.argon2.Memory, &h.argon2.Time, &h.argon2.Threads); err != nil {
+			return parsedHash{}, false
+		}
+		var err error
+		if h.salt, err = base64.RawStdEncoding.DecodeString(xs[4]); err != nil {
+			return parsedHash{}, false
+		}
+		if h.key, err = base64.RawStdEncoding.DecodeString(xs[5]); err != nil {
+			return parsedHash{}, false
+		}
+		h.argon2.SaltLen, h.argon2.KeyLen = uint32(len(h.salt)), uint32(len(h.key))
+		return h, true
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return parsedHash{}, false
+	}
+	return parsedHash{algorithm: HashBcrypt, cost: cost}, true
+}
+
+func verifyPassword(hash, pwd string) bool {
+	h, ok := parseHash(hash)
+	if !ok {
+		return false
+	}
+	if h.algorithm == HashBcrypt {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pwd)) == nil
+	}
+	a := h.argon2
+	key := argon2.IDKey([]byte(pwd), h.salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// outdated reports whether the hash was not created with the current
+// parameters and should be replaced.
+func (p HashParams) outdated(hash string) bool {
+	h, ok := parseHash(hash)
+	if !ok || h.algorithm != p.Algorithm {
+		return true
+	}
+	if h.algorithm == HashBcrypt {
+		return h.cost < p.BcryptCost
+	}
+	cur := p.Argon2
+	return h.argon2.Time < cur.Time || h.argon2.Memory < cur.Memory || h.argon2.Threads < cur.Threads ||
+		h.argon2.KeyLen < cur.KeyLen || h.argon2.SaltLen < cur.SaltLen
+}
+
+// rehashPassword replaces an outdated hash after the password was verified.
+// Failing to do so does not fail the login.
+func (s *Service) rehashPassword(u User, pwd string) {
+	if !s.hashParams.outdated(u.Password) {
+		return
+	}
+	hash, err := s.hashParams.hash(pwd)
+	if err != nil {
+		common.ErrorLogger.Println(err)
+		return
+	}
+	if _, err := s.db.Exec(`UPDATE users SET password=$1 WHERE id=$2 AND password=$3`, hash, u.ID, u.Password); err != nil {
+		common.ErrorLogger.Println(err)
+		return
+	}
+	common.InfoLogger.Printf("Password hash of %s upgraded to %s", u.Login, s.hashParams.Algorithm)
+}
+
+// HashReport counts the users per password hash scheme.
+type HashReport struct {
+	Current int          `json:"current"`
+	Legacy  int          `json:"legacy"`
+	Schemes []HashScheme `json:"schemes"`
+}
+
+type HashScheme struct {
+	Scheme   string `json:"scheme"`
+	Users    int    `json:"users"`
+	Outdated bool   `json:"outdated"`
+}
+
+func (s *Service) PasswordHashReport() (HashReport, error) {
+	rows, err := s.db.Query(`SELECT password FROM users WHERE id<>$1 AND password<>''`, DeletedUserID)
+	if err != nil {
+		return HashReport{}, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]*HashScheme)
+	var report HashReport
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return HashReport{}, common.DataBaseError(err)
+		}
+		scheme := "unknown"
+		if h, ok := parseHash(hash); ok && h.algorithm == HashBcrypt {
+			scheme = fmt.Sprintf("bcrypt cost=%d", h.cost)
+		} else if ok {
+			scheme = fmt.Sprintf("argon2id m=%d,t=%d,p=%d", h.argon2.Memory, h.argon2.Time, h.argon2.Threads)
+		}
+		outdated := s.hashParams.outdated(hash)
+		if outdated {
+			report.Legacy++
+		} else {
+			report.Current++
+		}
+		if counts[scheme] == nil {
+			counts[scheme] = &HashScheme{Scheme: scheme, Outdated: outdated}
+		}
+		counts[scheme].Users++
+	}
+	if err := rows.Err(); err != nil {
+		return HashReport{}, common.DataBaseError(err)
+	}
+
+	report.Schemes = make([]HashScheme, 0, len(counts))
+	for _, c := range counts {
+		report.Schemes = append(report.Schemes, *c)
+	}
+	sort.Slice(report.Schemes, func(i, j int) bool { return report.Schemes[i].Users > report.Schemes[j].Users })
+	return report, nil
+}
@@ -0,0 +1,259 @@
+package user
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"forum/internal/common"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const oauthStateTTL = 10 * time.Minute
+
+var notLoginChars = regexp.MustCompile(`[^0-9a-zA-Z]+`)
+
+// ErrIdentityNotLinked is returned for a first external login with the email
+// of an existing account. The identity is never linked on the strength of the
+// email alone: the owner has to log in and link it.
+var ErrIdentityNotLinked = common.NewAppError(nil,
+	"an account with this email already exists, log in and link the identity from your settings", http.StatusConflict)
+
+// ErrEmailNotVerified is returned for a first external login whose provider
+// has not verified the email: an account is never registered with an address
+// its owner has not confirmed.
+var ErrEmailNotVerified = common.NewAppError(nil,
+	"the identity provider has not verified your email address, verify it there or register with a password", http.StatusForbidden)
+
+// ExternalIdentity is a user as described by an external identity provider.
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Login         string
+	FirstName     string
+	LastName      string
+}
+
+// OAuthState is a pending external login. UserID is set when a logged-in user
+// links another identity to the account.
+type OAuthState struct {
+	State    string
+	Provider string
+	Nonce    string
+	Verifier string
+	UserID   string
+}
+
+type LinkedIdentity struct {
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s *Service) SaveOAuthState(st OAuthState) error {
+	var userID *string
+	if st.UserID != "" {
+		userID = &st.UserID
+	}
+	_, err := s.db.Exec(`INSERT INTO oauth_states (state, provider, nonce, verifier, user_id, expired_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		st.State, st.Provider, st.Nonce, st.Verifier, userID, time.Now().Add(oauthStateTTL))
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	return nil
+}
+
+// TakeOAuthState returns the pending login and removes it, so every state can
+// be used only once.
+func (s *Service) TakeOAuthState(state string) (OAuthState, error) {
+	row := s.db.QueryRow(`SELECT state, provider, nonce, verifier, coalesce(user_id, ''), expired_at FROM oauth_states WHERE state=$1`, state)
+	var (
+		st        OAuthState
+		expiredAt time.Time
+	)
+	if err := row.Scan(&st.State, &st.Provider, &st.Nonce, &st.Verifier, &st.UserID, &expiredAt); err != nil {
+		return OAuthState{}, common.InvalidArgumentError(err, "login request is invalid or expired")
+	}
+	if _, err := s.db.Exec(`DELETE FROM oauth_states WHERE state=$1 OR expired_at < $2`, state, time.Now()); err != nil {
+		return OAuthState{}, common.DataBaseError(err)
+	}
+	if time.Now().After(expiredAt) {
+		return OAuthState{}, common.InvalidArgumentError(nil, "login request is invalid or expired")
+	}
+	return st, nil
+}
+
+// LoginExternal signs in the user linked to the external identity. A new
+// account is created for unknown identities with a verified email, unless the
+// email belongs to an account already, which has to link the identity through
+// LinkExternal.
+func (s *Service) LoginExternal(ext ExternalIdentity) (LoginResult, error) {
+	u, err := s.findByIdentity(ext.Provider, ext.Subject)
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	if u.ID == "" {
+		if ext.Email != "" && !ext.EmailVerified {
+			return LoginResult{}, ErrEmailNotVerified
+		}
+		taken, err := s.emailTaken(ext.Email)
+		if err != nil {
+			return LoginResult{}, err
+		}
+		if taken {
+			return LoginResult{}, ErrIdentityNotLinked
+		}
+		u, err = s.registerExternal(ext)
+		if err != nil {
+			return LoginResult{}, err
+		}
+	}
+	return s.beginSession(u)
+}
+
+// LinkExternal attaches the identity to an existing account.
+func (s *Service) LinkExternal(userID string, ext ExternalIdentity) error {
+	u, err := s.findByIdentity(ext.Provider, ext.Subject)
+	if err != nil {
+		return err
+	}
+	if u.ID == userID {
+		return nil
+	}
+	if u.ID != "" {
+		return common.InvalidArgumentError(nil, "this identity is linked to another account")
+	}
+	return s.linkIdentity(userID, ext)
+}
+
+func (s *Service) UnlinkExternal(userID, provider string) error {
+	res, err := s.db.Exec(`DELETE FROM user_identities WHERE user_id=$1 AND provider=$2`, userID, provider)
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return common.NotFoundError(nil, "identity is not linked")
+	}
+	return nil
+}
+
+func (s *Service) LinkedIdentities(userID string) ([]LinkedIdentity, error) {
+	rows, err := s.db.Query(`SELECT provider, email, created_at FROM user_identities WHERE user_id=$1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	var identities []LinkedIdentity
+	for rows.Next() {
+		var li LinkedIdentity
+		if err := rows.Scan(&li.Provider, &li.Email, &li.CreatedAt); err != nil {
+			common.InfoLogger.Println(err)
+			continue
+		}
+		identities = append(identities, li)
+	}
+	return identities, nil
+}
+
+func (s *Service) findByIdentity(provider, subject string) (User, error) {
+	row := s.db.QueryRow(`SELECT user_id FROM user_identities WHERE provider=$1 AND subject=$2`, provider, subject)
+	var id string
+	if err := row.Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return User{}, nil
+		}
+		return User{}, common.DataBaseError(err)
+	}
+	return s.FindByCredential(id)
+}
+
+func (s *Service) emailTaken(email string) (bool, error) {
+	if email == "" {
+		return false, nil
+	}
+	var n int
+	if err := s.db.QueryRow(`SELECT count(*) FROM users WHERE lower(email)=lower($1)`, email).Scan(&n); err != nil {
+		return false, common.DataBaseError(err)
+	}
+	return n > 0, nil
+}
+
+func (s *Service) linkIdentity(userID string, ext ExternalIdentity) error {
+	_, err := s.db.Exec(`INSERT INTO user_identities (provider, subject, user_id, email) VALUES ($1, $2, $3, $4)`,
+		ext.Provider, ext.Subject, userID, ext.Email)
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	return nil
+}
+
+// registerExternal creates an account for a first-time external login. The
+// account gets a random password, so it can only be used through the provider
+// until the user sets one.
+func (s *Service) registerExternal(ext ExternalIdentity) (User, error) {
+	if ext.Email == "" {
+		return User{}, common.InvalidArgumentError(nil, "identity provider did not share an email address")
+	}
+	if err := validateEmail(ext.Email); err != nil {
+		return User{}, err
+	}
+
+	pwd := make([]byte, 32)
+	if _, err := rand.Read(pwd); err != nil {
+		return User{}, common.SystemError(err)
+	}
+	u := User{
+		Email:     ext.Email,
+		FirstName: ext.FirstName,
+		LastName:  ext.LastName,
+		Password:  fmt.Sprintf("%x", pwd),
+		Gender:    Other,
+		Role:      RoleUser,
+	}
+	u.generateID()
+	if err := s.hashPassword(&u); err != nil {
+		return User{}, err
+	}
+
+	base := loginFromIdentity(ext)
+	for i := 0; i < 10; i++ {
+		u.Login = base
+		if i > 0 {
+			u.Login = fmt.Sprintf("%s%d", base, i+1)
+		}
+		err := s.userToDB(u)
+		if err == nil {
+			break
+		}
+		if !strings.Contains(err.Error(), "login already exists") || i == 9 {
+			return User{}, err
+		}
+	}
+	if err := s.linkIdentity(u.ID, ext); err != nil {
+		return User{}, err
+	}
+	common.InfoLogger.Printf("New user %s registered through %s", u.Login, ext.Provider)
+	return u, nil
+}
+
+func loginFromIdentity(ext ExternalIdentity) string {
+	login := ext.Login
+	if login == "" {
+		login = strings.SplitN(ext.Email, "@", 2)[0]
+	}
+	login = notLoginChars.ReplaceAllString(login, "")
+	if len(login) > 32 {
+		login = login[:32]
+	}
+	for len(login) < 3 {
+		login += "0"
+	}
+	return login
+}
@@ -0,0 +1,131 @@
+package user
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"forum/internal/common"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// PasswordPolicy describes which passwords are accepted on registration and on
+// password change.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	// MinClasses is how many of lowercase letters, uppercase letters, digits
+	// and symbols the password has to contain.
+	MinClasses int
+	// DisallowPersonal rejects passwords containing the login or email.
+	DisallowPersonal bool
+	Breached         *BreachedList
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:        8,
+	MaxLength:        72,
+	MinClasses:       2,
+	DisallowPersonal: true,
+}
+
+func (s *Service) SetPasswordPolicy(p PasswordPolicy) {
+	s.pwdPolicy = p
+}
+
+func (p PasswordPolicy) validate(pwd, repeatPWD, login, email string) error {
+	if pwd == "" {
+		return common.InvalidArgumentError(nil, "password cannot be empty")
+	}
+	if len(pwd) < p.MinLength {
+		return common.InvalidArgumentError(nil, fmt.Sprintf("password is too short, it must be at least %d characters long", p.MinLength))
+	}
+	if p.MaxLength > 0 && len(pwd) > p.MaxLength {
+		return common.InvalidArgumentError(nil, fmt.Sprintf("password is too long, it must be at most %d characters long", p.MaxLength))
+	}
+	if pwd != repeatPWD {
+		return common.InvalidArgumentError(nil, "passwords do not match")
+	}
+	if n := charClasses(pwd); n < p.MinClasses {
+		return common.InvalidArgumentError(nil, fmt.Sprintf("password must contain at least %d of: lowercase letters, uppercase letters, digits, symbols", p.MinClasses))
+	}
+	if p.DisallowPersonal {
+		lower := strings.ToLower(pwd)
+		if len(login) >= 3 && strings.Contains(lower, strings.ToLower(login)) {
+			return common.InvalidArgumentError(nil, "password must not contain your login")
+		}
+		local := strings.SplitN(email, "@", 2)[0]
+		if len(local) >= 3 && strings.Contains(lower, strings.ToLower(local)) {
+			return common.InvalidArgumentError(nil, "password must not contain your email")
+		}
+	}
+	if p.Breached.Contains(pwd) {
+		return common.InvalidArgumentError(nil, "this password has appeared in a data breach, choose another one")
+	}
+	return nil
+}
+
+func charClasses(pwd string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range pwd {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// BreachedList holds SHA-1 hashes of compromised passwords grouped by their
+// first five hex characters, the same layout as k-anonymity range APIs use.
+type BreachedList struct {
+	ranges map[string]map[string]struct{}
+}
+
+// LoadBreachedList reads a file of PREFIX:SUFFIX lines. An optional third
+// field, such as a breach count, is ignored; so are blank lines and comments.
+func LoadBreachedList(path string) (*BreachedList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l := &BreachedList{ranges: make(map[string]map[string]struct{})}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		xs := strings.Split(line, ":")
+		if len(xs) < 2 || len(xs[0]) != 5 || len(xs[1]) != 35 {
+			return nil, fmt.Errorf("%s:%d: expected PREFIX:SUFFIX", path, n)
+		}
+		prefix, suffix := strings.ToUpper(xs[0]), strings.ToUpper(xs[1])
+		if l.ranges[prefix] == nil {
+			l.ranges[prefix] = make(map[string]struct{})
+		}
+		l.ranges[prefix][suffix] = struct{}{}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *BreachedList) Contains(pwd string) bool {
+	if l == nil {
+		return false
+	}
+	h := fmt.Sprintf("%X", sha1.Sum([]byte(pwd)))
+	_, ok := l.ranges[h[:5]][h[5:]]
+	return ok
+}
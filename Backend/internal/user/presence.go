@@ -0,0 +1,222 @@
+package user
+
+import (
+	"database/sql"
+	"errors"
+	"forum/internal/common"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// PresenceState is what other users see about the user's availability.
+type PresenceState string
+
+const (
+	PresenceOnline    PresenceState = "online"
+	PresenceAway      PresenceState = "away"
+	PresenceDND       PresenceState = "dnd"
+	PresenceInvisible PresenceState = "invisible"
+	PresenceOffline   PresenceState = "offline"
+)
+
+// IsMode reports whether users may choose the state themselves. Away and
+// offline are derived from activity and connections.
+func (p PresenceState) IsMode() bool {
+	return p == PresenceOnline || p == PresenceDND || p == PresenceInvisible
+}
+
+const (
+	// AwayAfter is how long a connected user has to be inactive to be shown
+	// as away.
+	AwayAfter             = 5 * time.Minute
+	maxCustomStatusLength = 100
+	// HeartbeatInterval is how often an instance confirms the connections
+	// it holds. A connection not confirmed for ConnectionTTL, because its
+	// instance stopped without closing it, no longer counts.
+	HeartbeatInterval = 30 * time.Second
+	ConnectionTTL     = 3 * HeartbeatInterval
+)
+
+// Presence is the presence of a user as seen by others. Invisible users are
+// shown as offline with the time they were last seen before hiding.
+type Presence struct {
+	UserID       string        `json:"user_id"`
+	Login        string        `json:"login"`
+	State        PresenceState `json:"state"`
+	CustomStatus string        `json:"custom_status,omitempty"`
+	LastSeen     *time.Time    `json:"last_seen,omitempty"`
+}
+
+type presenceRow struct {
+	login        string
+	connected    bool
+	mode         PresenceState
+	customStatus string
+	lastActive   time.Time
+	lastSeen     *time.Time
+}
+
+func (r presenceRow) presence(userID string, now time.Time) Presence {
+	p := Presence{UserID: userID, Login: r.login, State: PresenceOffline, LastSeen: r.lastSeen}
+	if r.mode == PresenceInvisible || !r.connected {
+		return p
+	}
+	p.CustomStatus = r.customStatus
+	p.LastSeen = nil
+	switch {
+	case r.mode == PresenceDND:
+		p.State = PresenceDND
+	case now.Sub(r.lastActive) > AwayAfter:
+		p.State = PresenceAway
+	default:
+		p.State = PresenceOnline
+	}
+	return p
+}
+
+// presenceQuery takes the time before which connections have expired.
+const presenceQuery = `SELECT u.id, u.login,
+       EXISTS(SELECT 1 FROM presence_connections c WHERE c.user_id = u.id AND c.heartbeat > $1),
+       coalesce(o.mode, 'online'), coalesce(o.custom_status, ''), o.last_active, o.last_seen
+FROM users u
+         LEFT JOIN online_status o ON o.user_id = u.id`
+
+func expiredBefore(now time.Time) time.Time {
+	return now.Add(-ConnectionTTL)
+}
+
+func scanPresence(row interface{ Scan(...interface{}) error }) (string, presenceRow, error) {
+	var (
+		id         string
+		r          presenceRow
+		lastActive *time.Time
+	)
+	err := row.Scan(&id, &r.login, &r.connected, &r.mode, &r.customStatus, &lastActive, &r.lastSeen)
+	if lastActive != nil {
+		r.lastActive = *lastActive
+	}
+	return id, r, err
+}
+
+func (s *Service) Presence(userID string) (Presence, error) {
+	now := time.Now()
+	id, r, err := scanPresence(s.db.QueryRow(presenceQuery+` WHERE u.id=$2`, expiredBefore(now), userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Presence{}, common.NotFoundError(nil, "cannot find user with this login")
+	}
+	if err != nil {
+		return Presence{}, common.DataBaseError(err)
+	}
+	return r.presence(id, now), nil
+}
+
+// Presences returns the presence of every user by ID.
+func (s *Service) Presences() (map[string]Presence, error) {
+	now := time.Now()
+	rows, err := s.db.Query(presenceQuery, expiredBefore(now))
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	res := make(map[string]Presence)
+	for rows.Next() {
+		id, r, err := scanPresence(rows)
+		if err != nil {
+			return nil, common.DataBaseError(err)
+		}
+		res[id] = r.presence(id, now)
+	}
+	return res, rows.Err()
+}
+
+// SetConnected records that a forum instance got the first chat connection of
+// the user or lost the last one. Each instance has its own row, so the user
+// stays online while any of them holds a connection, and the rows of an
+// instance which stopped without closing its connections expire.
+func (s *Service) SetConnected(userID, instanceID string, connected bool) error {
+	now := time.Now()
+	var err error
+	if connected {
+		_, err = s.db.Exec(`INSERT INTO presence_connections (user_id, instance_id, heartbeat) VALUES ($1, $2, $3)
+ON CONFLICT (user_id, instance_id) DO UPDATE SET heartbeat=excluded.heartbeat`, userID, instanceID, now)
+	} else {
+		_, err = s.db.Exec(`DELETE FROM presence_connections WHERE user_id=$1 AND instance_id=$2`, userID, instanceID)
+	}
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	// the user may have been erased while connected
+	_, err = s.db.Exec(`INSERT INTO online_status (user_id, last_active)
+SELECT $1, $2 WHERE EXISTS(SELECT 1 FROM users WHERE id=$1)
+ON CONFLICT (user_id) DO UPDATE SET last_active=excluded.last_active,
+    last_seen=CASE WHEN mode='invisible' THEN last_seen ELSE excluded.last_active END`, userID, now)
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	return nil
+}
+
+// Heartbeat confirms the connections held by the instance, and removes the
+// expired ones of any instance. The users of those were last seen at their
+// last activity; their IDs are returned, for their presence to be pushed.
+func (s *Service) Heartbeat(instanceID string) ([]string, error) {
+	now := time.Now()
+	if _, err := s.db.Exec(`UPDATE presence_connections SET heartbeat=$1 WHERE instance_id=$2`, now, instanceID); err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	_, err := s.db.Exec(`UPDATE online_status SET last_seen=last_active
+WHERE mode<>'invisible' AND user_id IN (SELECT user_id FROM presence_connections WHERE heartbeat <= $1)`, expiredBefore(now))
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	rows, err := s.db.Query(`DELETE FROM presence_connections WHERE heartbeat <= $1 RETURNING user_id`, expiredBefore(now))
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	var expired []string
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, common.DataBaseError(err)
+		}
+		if !seen[id] {
+			seen[id] = true
+			expired = append(expired, id)
+		}
+	}
+	return expired, rows.Err()
+}
+
+// Touch records activity of a connected user.
+func (s *Service) Touch(userID string) error {
+	_, err := s.db.Exec(`UPDATE online_status SET last_active=$1 WHERE user_id=$2`, time.Now(), userID)
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	return nil
+}
+
+// SetPresence sets the chosen state and the custom status text.
+func (s *Service) SetPresence(userID string, mode PresenceState, customStatus string) error {
+	if !mode.IsMode() {
+		return common.InvalidArgumentError(nil, "state must be one of online, dnd, invisible")
+	}
+	customStatus = strings.TrimSpace(customStatus)
+	if utf8.RuneCountInString(customStatus) > maxCustomStatusLength {
+		return common.InvalidArgumentError(nil, "custom status is too long")
+	}
+	now := time.Now()
+	_, err := s.db.Exec(`INSERT INTO online_status (user_id, mode, custom_status, last_active) VALUES ($1, $2, $3, $4)
+ON CONFLICT (user_id) DO UPDATE SET mode=excluded.mode, custom_status=excluded.custom_status,
+    last_seen=CASE WHEN mode<>'invisible' AND EXISTS(SELECT 1 FROM presence_connections c WHERE c.user_id=excluded.user_id AND c.heartbeat > $5)
+        THEN excluded.last_active ELSE last_seen END`, userID, mode, customStatus, now, expiredBefore(now))
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package user
+
+import (
+	"crypto/rand"
+	"fmt"
+	"forum/internal/common"
+	"strings"
+	"time"
+)
+
+const emailChangeTTL = 24 * time.Hour
+
+// Mailer delivers messages to users.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// LogMailer writes messages to the log instead of sending them. It is used
+// until a real mail server is configured.
+type LogMailer struct{}
+
+func (LogMailer) Send(to, subject, body string) error {
+	common.InfoLogger.Printf("Mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+func (s *Service) SetMailer(m Mailer) {
+	s.mailer = m
+}
+
+// ProfileUpdate holds the profile fields to change; nil fields are kept.
+type ProfileUpdate struct {
+	FirstName *string `json:"first_name"`
+	LastName  *string `json:"last_name"`
+	Age       *uint   `json:"age"`
+	Gender    *Gender `json:"gender"`
+}
+
+func (s *Service) UpdateProfile(userID string, upd ProfileUpdate) (User, error) {
+	u, err := s.FindByCredential(userID)
+	if err != nil {
+		return User{}, err
+	}
+	if upd.FirstName != nil {
+		u.FirstName = strings.TrimSpace(*upd.FirstName)
+	}
+	if upd.LastName != nil {
+		u.LastName = strings.TrimSpace(*upd.LastName)
+	}
+	if upd.Age != nil {
+		u.Age = *upd.Age
+	}
+	if upd.Gender != nil {
+		if *upd.Gender > Female {
+			return User{}, common.InvalidArgumentError(nil, "gender is invalid")
+		}
+		u.Gender = *upd.Gender
+	}
+	if err := validateName(u.FirstName, u.LastName); err != nil {
+		return User{}, err
+	}
+	if err := validateAge(u.Age); err != nil {
+		return User{}, err
+	}
+
+	_, err = s.db.Exec(`UPDATE users SET first_name=$1, last_name=$2, age=$3, gender=$4 WHERE id=$5`,
+		u.FirstName, u.LastName, u.Age, u.Gender, u.ID)
+	if err != nil {
+		return User{}, common.DataBaseError(err)
+	}
+	u.cleanUp()
+	return u, nil
+}
+
+func (s *Service) ChangeLogin(userID, login string) error {
+	if err := validateLogin(login); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`UPDATE users SET login=$1 WHERE id=$2`, login, userID); err != nil {
+		return uniqueError(err)
+	}
+	return nil
+}
+
+func (s *Service) ChangePassword(userID, current, pwd, repeatPWD string) error {
+	u, err := s.FindByCredential(userID)
+	if err != nil {
+		return err
+	}
+	if !u.comparePassword(u.Password, current) {
+		return common.InvalidArgumentError(nil, "current password is incorrect")
+	}
+	if err := s.pwdPolicy.validate(pwd, repeatPWD, u.Login, u.Email); err != nil {
+		return err
+	}
+	u.Password = pwd
+	if err := s.hashPassword(&u); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`UPDATE users SET password=$1 WHERE id=$2`, u.Password, u.ID); err != nil {
+		return common.DataBaseError(err)
+	}
+	return nil
+}
+
+// RequestEmailChange sends a verification link to the new address. The email
+// is changed only after the link is opened.
+func (s *Service) RequestEmailChange(userID, pwd, email string) error {
+	u, err := s.FindByCredential(userID)
+	if err != nil {
+		return err
+	}
+	if !u.comparePassword(u.Password, pwd) {
+		return common.InvalidArgumentError(nil, "password is incorrect")
+	}
+	if err := validateEmail(email); err != nil {
+		return err
+	}
+	if strings.EqualFold(email, u.Email) {
+		return common.InvalidArgumentError(nil, "this is your current email")
+	}
+	if other, err := s.FindByCredential(email); err == nil && other.ID != u.ID {
+		return common.InvalidArgumentError(nil, "user with this email already exists")
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return common.SystemError(err)
+	}
+	token := fmt.Sprintf("%x", buf)
+	if _, err := s.db.Exec(`DELETE FROM email_changes WHERE user_id=$1`, u.ID); err != nil {
+		return common.DataBaseError(err)
+	}
+	_, err = s.db.Exec(`INSERT INTO email_changes (token_hash, user_id, new_email, expired_at) VALUES ($1, $2, $3, $4)`,
+		hashToken(token), u.ID, email, time.Now().Add(emailChangeTTL))
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+
+	body := fmt.Sprintf("Hello %s,\n\nopen /profile/email/verify?token=%s to confirm your new email address.", u.Login, token)
+	if err := s.mailer.Send(email, "Confirm your email", body); err != nil {
+		return common.SystemError(err)
+	}
+	return nil
+}
+
+// VerifyEmailChange applies the email change of the link and returns the ID
+// of the user.
+func (s *Service) VerifyEmailChange(token string) (string, error) {
+	row := s.db.QueryRow(`SELECT user_id, new_email, expired_at FROM email_changes WHERE token_hash=$1`, hashToken(token))
+	var (
+		userID, email string
+		expiredAt     time.Time
+	)
+	if err := row.Scan(&userID, &email, &expiredAt); err != nil {
+		return "", common.InvalidArgumentError(err, "verification link is invalid or expired")
+	}
+	if _, err := s.db.Exec(`DELETE FROM email_changes WHERE user_id=$1`, userID); err != nil {
+		return "", common.DataBaseError(err)
+	}
+	if time.Now().After(expiredAt) {
+		return "", common.InvalidArgumentError(nil, "verification link is invalid or expired")
+	}
+	if _, err := s.db.Exec(`UPDATE users SET email=$1 WHERE id=$2`, email, userID); err != nil {
+		return "", uniqueError(err)
+	}
+	return userID, nil
+}
@@ -14,21 +14,35 @@ import (
 )
 
 type Service struct {
-	db *sql.DB
+	db         *sql.DB
+	deletion   DeletionPolicy
+	mailer     Mailer
+	onEvent    func(SecurityEvent)
+	pwdPolicy  PasswordPolicy
+	hashParams HashParams
 }
 
 func NewService(db *sql.DB) *Service {
 	return &Service{
-		db: db,
+		db:         db,
+		deletion:   DefaultDeletionPolicy,
+		mailer:     LogMailer{},
+		onEvent:    logEvent,
+		pwdPolicy:  DefaultPasswordPolicy,
+		hashParams: DefaultHashParams,
 	}
 }
 
 func (s *Service) Register(user User) (User, error) {
-	if err := validateUser(user); err != nil {
+	if err := validateUser(user, s.pwdPolicy); err != nil {
 		return User{}, err
 	}
 	user.generateID()
-	user.hashPassword()
+	user.Role = RoleUser
+	user.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	if err := s.hashPassword(&user); err != nil {
+		return User{}, err
+	}
 	if err := s.userToDB(user); err != nil {
 		return User{}, err
 	}
@@ -39,54 +53,101 @@ func (s *Service) Register(user User) (User, error) {
 }
 
 var (
-	userCol    = "id, email, login, password, age, gender, first_name, last_name"
+	userCol    = "id, email, login, password, age, gender, first_name, last_name, role"
 	sessionCol = "session_key, user_id, expired_at"
 )
 
+// userToDB stores a new user. The creation time is set here rather than left
+// to the column default, which is a constant in databases migrated from
+// before the column existed.
 func (s *Service) userToDB(user User) error {
-	query := fmt.Sprintf("INSERT INTO users (%s) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)", userCol)
-	if _, err := s.db.Exec(query, user.ID, user.Email, user.Login, user.Password, user.Age, user.Gender, user.FirstName, user.LastName); err != nil {
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	}
+	query := fmt.Sprintf("INSERT INTO users (%s, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)", userCol)
+	if _, err := s.db.Exec(query, user.ID, user.Email, user.Login, user.Password, user.Age, user.Gender, user.FirstName, user.LastName, user.Role, user.CreatedAt); err != nil {
 		common.ErrorLogger.Println(err)
-		var sErr sqlite3.Error
-		if errors.As(err, &sErr) {
-			if strings.Contains(err.Error(), "UNIQUE constraint failed: users.email") {
-				return common.InvalidArgumentError(nil, "user with this email already exists")
-			}
-			if strings.Contains(err.Error(), "UNIQUE constraint failed: users.login") {
-				return common.InvalidArgumentError(nil, "user with this login already exists")
-			}
-		}
-		return common.SystemError(err)
+		return uniqueError(err)
 	}
 	return nil
 }
 
-func (s *Service) NewSession(str, pwd string) (string, error) {
+// uniqueError turns violations of the unique email and login indexes into
+// errors which can be shown to the user.
+func uniqueError(err error) error {
+	var sErr sqlite3.Error
+	if errors.As(err, &sErr) {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed: users.email") {
+			return common.InvalidArgumentError(nil, "user with this email already exists")
+		}
+		if strings.Contains(err.Error(), "UNIQUE constraint failed: users.login") {
+			return common.InvalidArgumentError(nil, "user with this login already exists")
+		}
+	}
+	return common.SystemError(err)
+}
+
+// NewSession checks the credentials and opens a session. Users with two-factor
+// authentication enabled get a pending challenge instead, which has to be
+// completed with VerifyChallenge. Failed attempts are throttled per account
+// and per IP address.
+func (s *Service) NewSession(str, pwd string, c Client) (LoginResult, error) {
 
-	u, err := s.FindByCredential(str)
+	u, err := s.checkPasswordLogin(str, pwd, c)
 	if err != nil {
-		return "", err
+		return LoginResult{}, err
+	}
+	s.rehashPassword(u, pwd)
+	res, err := s.beginSession(u)
+	if err == nil && res.Challenge == "" {
+		s.resetAttempts(accountKey(u, str))
 	}
-	if !u.comparePassword(u.Password, pwd) {
-		return "", common.InvalidArgumentError(nil, "password is incorrect")
+	return res, err
+}
+
+// beginSession opens a session for an authenticated user, or a two-factor
+// challenge if the user has enrolled.
+func (s *Service) beginSession(u User) (LoginResult, error) {
+	enabled, err := s.HasTwoFactor(u.ID)
+	if err != nil {
+		return LoginResult{}, err
 	}
+	if enabled {
+		challenge, err := s.createChallenge(u.ID)
+		if err != nil {
+			return LoginResult{}, err
+		}
+		return LoginResult{Challenge: challenge}, nil
+	}
+	return s.startSession(u)
+}
+
+func (s *Service) startSession(u User) (LoginResult, error) {
 	sessionID := generateCookieCode()
 	if err := s.createSession(u.ID, sessionID); err != nil {
-		return "", err
+		return LoginResult{}, err
 	}
 	//if err := s.UpdateStatus(u.ID); err != nil {
 	//	return "", err
 	//}
 	//fmt.Println(u.Login, " is online")
-	return sessionID + "|" + u.ID, nil
+	res := LoginResult{Session: sessionID + "|" + u.ID, UserID: u.ID}
+	if u.Role.IsPrivileged() {
+		required, err := s.TwoFactorRequired(u.Role)
+		if err != nil {
+			return LoginResult{}, err
+		}
+		res.TwoFactorSetup = required
+	}
+	return res, nil
 }
 
 func (s *Service) FindByCredential(str string) (User, error) {
-	query := fmt.Sprintf("SELECT %s FROM users WHERE login=$1 OR email=$1 OR id=$1", userCol)
+	query := fmt.Sprintf("SELECT %s, created_at FROM users WHERE login=$1 OR email=$1 OR id=$1", userCol)
 	row := s.db.QueryRow(query, str)
 
 	var u User
-	err := row.Scan(&u.ID, &u.Email, &u.Login, &u.Password, &u.Age, &u.Gender, &u.FirstName, &u.LastName)
+	err := row.Scan(&u.ID, &u.Email, &u.Login, &u.Password, &u.Age, &u.Gender, &u.FirstName, &u.LastName, &u.Role, &u.CreatedAt)
 	if err != nil {
 		return User{}, common.NotFoundError(nil, "cannot find user with this login")
 	}
@@ -123,11 +184,11 @@ func generateCookieCode() string {
 }
 
 func (s *Service) CheckSession(key, userID string) (User, error) {
-	query := fmt.Sprintf("SELECT u.id, u.email, u.login FROM sessions INNER JOIN users u on u.id = sessions.user_id WHERE session_key=$1 AND user_id=$2")
+	query := fmt.Sprintf("SELECT u.id, u.email, u.login, u.role FROM sessions INNER JOIN users u on u.id = sessions.user_id WHERE session_key=$1 AND user_id=$2")
 	row := s.db.QueryRow(query, key, userID)
 
 	var user User
-	err := row.Scan(&user.ID, &user.Email, &user.Login)
+	err := row.Scan(&user.ID, &user.Email, &user.Login, &user.Role)
 	if err != nil {
 		common.InfoLogger.Println(err)
 		return User{}, common.InvalidArgumentError(err, "no current session")
@@ -175,12 +236,30 @@ func (s *Service) LogOut(userID string) error {
 //	return nil
 //}
 
+// SetRole changes the role of the user and returns the previous one.
+func (s *Service) SetRole(userID string, role Role) (Role, error) {
+	if !role.IsValid() {
+		return "", common.InvalidArgumentError(nil, "unknown role")
+	}
+	u, err := s.FindByCredential(userID)
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.db.Exec(`UPDATE users SET role=$1 WHERE id=$2`, role, u.ID); err != nil {
+		return "", common.DataBaseError(err)
+	}
+	return u.Role, nil
+}
+
 func (s *Service) FindUser(id string) (User, error) {
 	var u User
 	u, err := s.FindByCredential(id)
 	if err != nil {
 		return User{}, err
 	}
+	if u.DeletionAt, err = s.ScheduledDeletion(u.ID); err != nil {
+		return User{}, err
+	}
 	u.cleanUp()
 	return u, nil
 }
@@ -195,30 +274,25 @@ func (s *Service) FindUser(id string) (User, error) {
 //	return nil
 //}
 
-func (s *Service) FindAllUsers(login string) ([]User, error) {
-	user, err := s.FindByCredential(login)
+// ChatDirectory returns every user but the placeholder of the deleted
+// accounts, by login, for the chat user lists.
+func (s *Service) ChatDirectory() ([]User, error) {
+	rows, err := s.db.Query(`SELECT id, login FROM users WHERE id <> $1 ORDER BY login COLLATE NOCASE`, DeletedUserID)
 	if err != nil {
-		return nil, err
-	}
-	rows, err := s.db.Query(`select u.login, u.id from users u
-  left outer join chat c on (u.id = msg_from OR u.id = c.msg_to) AND (c.msg_from=$1 or c.msg_to=$1)
-where u.id <> $1
-group by u.login
-ORDER BY max(c.send_at) DESC, u.login COLLATE NOCASE ASC;`, user.ID)
-	if err != nil {
-		return nil, err
+		return nil, common.DataBaseError(err)
 	}
 	defer rows.Close()
 
-	var userList []User
+	var users []User
 	for rows.Next() {
-		var us User
-		err := rows.Scan(&us.Login, &us.ID)
-		if err != nil {
-			common.InfoLogger.Println(err)
-			continue
+		var u User
+		if err := rows.Scan(&u.ID, &u.Login); err != nil {
+			return nil, common.DataBaseError(err)
 		}
-		userList = append(userList, us)
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, common.DataBaseError(err)
 	}
-	return userList, nil
+	return users, nil
 }
@@ -0,0 +1,259 @@
+package user
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"forum/internal/common"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// throttlePolicy describes how failed logins for one key are slowed down.
+// After freeAttempts failures every further failure blocks the key for an
+// exponentially growing delay; after lockoutAfter failures the key is locked.
+type throttlePolicy struct {
+	freeAttempts int
+	baseDelay    time.Duration
+	maxDelay     time.Duration
+	lockoutAfter int
+	lockoutFor   time.Duration
+	window       time.Duration
+}
+
+var (
+	accountThrottle = throttlePolicy{
+		freeAttempts: 3,
+		baseDelay:    2 * time.Second,
+		maxDelay:     5 * time.Minute,
+		lockoutAfter: 10,
+		lockoutFor:   30 * time.Minute,
+		window:       time.Hour,
+	}
+	ipThrottle = throttlePolicy{
+		freeAttempts: 10,
+		baseDelay:    time.Second,
+		maxDelay:     5 * time.Minute,
+		lockoutAfter: 50,
+		lockoutFor:   time.Hour,
+		window:       time.Hour,
+	}
+
+	// ErrInvalidCredentials is returned for every failed password login, so
+	// the response does not tell whether the account exists.
+	ErrInvalidCredentials = common.InvalidArgumentError(nil, "login or password is incorrect")
+	ErrTooManyAttempts    = common.NewAppError(nil, "too many failed login attempts, try again later", http.StatusTooManyRequests)
+)
+
+const unlockTTL = 24 * time.Hour
+
+func accountKey(u User, credential string) string {
+	if u.ID != "" {
+		return "account:" + u.ID
+	}
+	return "account:" + strings.ToLower(strings.TrimSpace(credential))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// checkPasswordLogin verifies the credentials while applying the per-account
+// and per-IP throttling.
+func (s *Service) checkPasswordLogin(credential, pwd string, c Client) (User, error) {
+	if locked, err := s.isThrottled(ipKey(c.IP)); err != nil || locked {
+		if err != nil {
+			return User{}, err
+		}
+		return User{}, ErrTooManyAttempts
+	}
+
+	u, err := s.FindByCredential(credential)
+	var notFound *common.AppError
+	if err != nil && !(errors.As(err, &notFound) && notFound.StatusCode == http.StatusNotFound) {
+		return User{}, err
+	}
+	aKey := accountKey(u, credential)
+	if locked, err := s.isThrottled(aKey); err != nil || locked {
+		if err != nil {
+			return User{}, err
+		}
+		return User{}, ErrTooManyAttempts
+	}
+
+	if u.ID == "" {
+		// Hashing takes as long as verifying, so the response does not
+		// tell whether the account exists.
+		_, _ = s.hashParams.hash(pwd)
+	} else if u.comparePassword(u.Password, pwd) {
+		// The attempts are reset once the login completes, after the
+		// two-factor check if any, so a known password does not clear the
+		// failed codes.
+		return u, nil
+	}
+
+	s.recordFailure(u, credential, c, "")
+	return User{}, ErrInvalidCredentials
+}
+
+func (s *Service) isThrottled(key string) (bool, error) {
+	row := s.db.QueryRow(`SELECT locked_until FROM login_attempts WHERE attempt_key=$1`, key)
+	var lockedUntil *time.Time
+	if err := row.Scan(&lockedUntil); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, common.DataBaseError(err)
+	}
+	return lockedUntil != nil && time.Now().Before(*lockedUntil), nil
+}
+
+// checkLoginThrottle returns ErrTooManyAttempts while the account or the
+// address is locked out.
+func (s *Service) checkLoginThrottle(u User, c Client) error {
+	for _, key := range []string{ipKey(c.IP), accountKey(u, "")} {
+		locked, err := s.isThrottled(key)
+		if err != nil {
+			return err
+		}
+		if locked {
+			return ErrTooManyAttempts
+		}
+	}
+	return nil
+}
+
+// recordFailure counts a failed password or two-factor check against the
+// account and the address.
+func (s *Service) recordFailure(u User, credential string, c Client, details string) {
+	e := SecurityEvent{Type: EventLoginFailed, UserID: u.ID, Login: credential, IP: c.IP, UserAgent: c.UserAgent, Details: details}
+	s.emit(e)
+
+	failures, locked := s.addFailure(accountKey(u, credential), accountThrottle)
+	switch {
+	case locked:
+		e.Type = EventAccountLocked
+		e.Details = fmt.Sprintf("%d failed attempts", failures)
+		s.emit(e)
+		if u.ID != "" {
+			s.sendUnlockLink(u)
+		}
+	case failures > accountThrottle.freeAttempts:
+		e.Type = EventRepeatedFailures
+		e.Details = fmt.Sprintf("%d failed attempts for the account", failures)
+		s.emit(e)
+	}
+
+	failures, locked = s.addFailure(ipKey(c.IP), ipThrottle)
+	if locked || failures > ipThrottle.freeAttempts {
+		e.Type = EventRepeatedFailures
+		e.UserID = ""
+		e.Details = fmt.Sprintf("%d failed attempts from the address", failures)
+		s.emit(e)
+	}
+}
+
+// addFailure counts the failure and blocks the key according to the policy.
+// It reports the number of failures and whether the key got locked out now.
+func (s *Service) addFailure(key string, p throttlePolicy) (int, bool) {
+	now := time.Now()
+	var (
+		failures    int
+		lastFailure time.Time
+	)
+	row := s.db.QueryRow(`SELECT failures, last_failure FROM login_attempts WHERE attempt_key=$1`, key)
+	if err := row.Scan(&failures, &lastFailure); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		common.ErrorLogger.Println(err)
+		return 0, false
+	}
+	if now.Sub(lastFailure) > p.window {
+		failures = 0
+	}
+	failures++
+
+	var lockedUntil *time.Time
+	locked := false
+	switch {
+	case failures >= p.lockoutAfter:
+		t := now.Add(p.lockoutFor)
+		lockedUntil = &t
+		locked = failures == p.lockoutAfter
+	case failures > p.freeAttempts:
+		delay := p.baseDelay << uint(failures-p.freeAttempts-1)
+		if delay > p.maxDelay || delay <= 0 {
+			delay = p.maxDelay
+		}
+		t := now.Add(delay)
+		lockedUntil = &t
+	}
+
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO login_attempts (attempt_key, failures, last_failure, locked_until) VALUES ($1, $2, $3, $4)`,
+		key, failures, now, lockedUntil)
+	if err != nil {
+		common.ErrorLogger.Println(err)
+	}
+	return failures, locked
+}
+
+func (s *Service) resetAttempts(key string) {
+	if _, err := s.db.Exec(`DELETE FROM login_attempts WHERE attempt_key=$1`, key); err != nil {
+		common.ErrorLogger.Println(err)
+	}
+}
+
+func (s *Service) sendUnlockLink(u User) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		common.ErrorLogger.Println(err)
+		return
+	}
+	token := fmt.Sprintf("%x", buf)
+	_, err := s.db.Exec(`INSERT INTO account_unlocks (token_hash, user_id, expired_at) VALUES ($1, $2, $3)`,
+		hashToken(token), u.ID, time.Now().Add(unlockTTL))
+	if err != nil {
+		common.ErrorLogger.Println(err)
+		return
+	}
+	body := fmt.Sprintf("Hello %s,\n\nyour account was locked after too many failed login attempts. "+
+		"Open /login/unlock?token=%s to unlock it, and change your password if these attempts were not yours.", u.Login, token)
+	if err := s.mailer.Send(u.Email, "Your account was locked", body); err != nil {
+		common.ErrorLogger.Println(err)
+	}
+}
+
+// UnlockWithToken unlocks the account with the link sent on lockout.
+func (s *Service) UnlockWithToken(token string) error {
+	row := s.db.QueryRow(`SELECT user_id, expired_at FROM account_unlocks WHERE token_hash=$1`, hashToken(token))
+	var (
+		userID    string
+		expiredAt time.Time
+	)
+	if err := row.Scan(&userID, &expiredAt); err != nil {
+		return common.InvalidArgumentError(err, "unlock link is invalid or expired")
+	}
+	if _, err := s.db.Exec(`DELETE FROM account_unlocks WHERE user_id=$1`, userID); err != nil {
+		return common.DataBaseError(err)
+	}
+	if time.Now().After(expiredAt) {
+		return common.InvalidArgumentError(nil, "unlock link is invalid or expired")
+	}
+	s.resetAttempts("account:" + userID)
+	s.emit(SecurityEvent{Type: EventAccountUnlocked, UserID: userID, Details: "unlocked by email link"})
+	return nil
+}
+
+// Unlock clears the failed attempts of the account, for admins.
+func (s *Service) Unlock(credential, actorID string) error {
+	u, err := s.FindByCredential(credential)
+	if err != nil {
+		return err
+	}
+	s.resetAttempts("account:" + u.ID)
+	if _, err := s.db.Exec(`DELETE FROM account_unlocks WHERE user_id=$1`, u.ID); err != nil {
+		return common.DataBaseError(err)
+	}
+	s.emit(SecurityEvent{Type: EventAccountUnlocked, UserID: u.ID, Login: u.Login, ActorID: actorID, Details: "unlocked by an administrator"})
+	return nil
+}
@@ -0,0 +1,191 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"forum/internal/common"
+	"strings"
+	"time"
+)
+
+const (
+	tokenPrefix        = "fpat_"
+	defaultTokenDays   = 30
+	maxTokenDays       = 365
+	maxTokensPerUser   = 50
+	tokenNameMaxLength = 100
+)
+
+// Scope limits what a personal access token may be used for.
+type Scope string
+
+const (
+	ScopeRead  Scope = "read"
+	ScopeWrite Scope = "write"
+	ScopeChat  Scope = "chat"
+)
+
+func (s Scope) IsValid() bool {
+	return s == ScopeRead || s == ScopeWrite || s == ScopeChat
+}
+
+// Token describes a personal access token. The secret value itself is only
+// returned once, when the token is created.
+type Token struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []Scope    `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Value      string     `json:"token,omitempty"`
+}
+
+func (t Token) HasScope(scope Scope) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateToken issues a new personal access token for the user.
+func (s *Service) CreateToken(userID, name string, scopes []Scope, days int) (Token, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Token{}, common.InvalidArgumentError(nil, "token name is required")
+	}
+	if len(name) > tokenNameMaxLength {
+		return Token{}, common.InvalidArgumentError(nil, "token name is too long")
+	}
+	if len(scopes) == 0 {
+		return Token{}, common.InvalidArgumentError(nil, "at least one scope is required")
+	}
+	for _, sc := range scopes {
+		if !sc.IsValid() {
+			return Token{}, common.InvalidArgumentError(nil, fmt.Sprintf("unknown scope %q", sc))
+		}
+	}
+	if days == 0 {
+		days = defaultTokenDays
+	}
+	if days < 0 || days > maxTokenDays {
+		return Token{}, common.InvalidArgumentError(nil, fmt.Sprintf("token lifetime must be between 1 and %d days", maxTokenDays))
+	}
+
+	var count int
+	if err := s.db.QueryRow(`SELECT count() FROM api_tokens WHERE user_id=$1`, userID).Scan(&count); err != nil {
+		return Token{}, common.DataBaseError(err)
+	}
+	if count >= maxTokensPerUser {
+		return Token{}, common.InvalidArgumentError(nil, "too many tokens, revoke unused ones first")
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return Token{}, common.SystemError(err)
+	}
+	t := Token{
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().AddDate(0, 0, days),
+		Value:     fmt.Sprintf("%s%x", tokenPrefix, buf),
+	}
+
+	row := s.db.QueryRow(`INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6) returning id`,
+		userID, t.Name, hashToken(t.Value), joinScopes(scopes), t.CreatedAt, t.ExpiresAt)
+	if err := row.Scan(&t.ID); err != nil {
+		return Token{}, common.DataBaseError(err)
+	}
+	return t, nil
+}
+
+func (s *Service) ListTokens(userID string) ([]Token, error) {
+	rows, err := s.db.Query(`SELECT id, name, scopes, created_at, expires_at, last_used_at FROM api_tokens WHERE user_id=$1 ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	defer rows.Close()
+
+	tokens := []Token{}
+	for rows.Next() {
+		var (
+			t      Token
+			scopes string
+		)
+		if err := rows.Scan(&t.ID, &t.Name, &scopes, &t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt); err != nil {
+			common.InfoLogger.Println(err)
+			continue
+		}
+		t.Scopes = splitScopes(scopes)
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+func (s *Service) RevokeToken(userID string, id int) error {
+	res, err := s.db.Exec(`DELETE FROM api_tokens WHERE id=$1 AND user_id=$2`, id, userID)
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return common.NotFoundError(nil, "token not found")
+	}
+	return nil
+}
+
+// CheckToken resolves a bearer token to its owner, the same way CheckSession
+// does for the session cookie.
+func (s *Service) CheckToken(value string) (User, Token, error) {
+	if !strings.HasPrefix(value, tokenPrefix) {
+		return User{}, Token{}, common.InvalidArgumentError(nil, "token is invalid")
+	}
+	row := s.db.QueryRow(`SELECT u.id, u.email, u.login, u.role, t.id, t.name, t.scopes, t.created_at, t.expires_at
+FROM api_tokens t INNER JOIN users u on u.id = t.user_id WHERE t.token_hash=$1`, hashToken(value))
+
+	var (
+		u      User
+		t      Token
+		scopes string
+	)
+	if err := row.Scan(&u.ID, &u.Email, &u.Login, &u.Role, &t.ID, &t.Name, &scopes, &t.CreatedAt, &t.ExpiresAt); err != nil {
+		return User{}, Token{}, common.InvalidArgumentError(err, "token is invalid")
+	}
+	if time.Now().After(t.ExpiresAt) {
+		return User{}, Token{}, common.InvalidArgumentError(nil, "token is expired")
+	}
+	t.Scopes = splitScopes(scopes)
+
+	now := time.Now()
+	t.LastUsedAt = &now
+	if _, err := s.db.Exec(`UPDATE api_tokens SET last_used_at=$1 WHERE id=$2`, now, t.ID); err != nil {
+		common.WarningLogger.Println(err)
+	}
+	return u, t, nil
+}
+
+func hashToken(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return fmt.Sprintf("%x", sum)
+}
+
+func joinScopes(scopes []Scope) string {
+	xs := make([]string, len(scopes))
+	for i, s := range scopes {
+		xs[i] = string(s)
+	}
+	return strings.Join(xs, ",")
+}
+
+func splitScopes(s string) []Scope {
+	var scopes []Scope
+	for _, x := range strings.Split(s, ",") {
+		if x != "" {
+			scopes = append(scopes, Scope(x))
+		}
+	}
+	return scopes
+}
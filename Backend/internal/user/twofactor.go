@@ -0,0 +1,332 @@
+package user
+
+import (
+	"database/sql"
+	"errors"
+	"forum/internal/common"
+	"net/http"
+	"time"
+)
+
+const (
+	challengeTTL         = 5 * time.Minute
+	maxChallengeAttempts = 5
+)
+
+var (
+	ErrTwoFactorRequired = common.NewAppError(nil, "two-factor authentication is required for this role", http.StatusForbidden)
+	errInvalidCode       = common.InvalidArgumentError(nil, "verification code is invalid")
+)
+
+// LoginResult is the outcome of the first login step. Exactly one of Session
+// and Challenge is set.
+type LoginResult struct {
+	Session        string `json:"-"`
+	UserID         string `json:"-"`
+	Challenge      string `json:"challenge,omitempty"`
+	TwoFactorSetup bool   `json:"two_factor_setup,omitempty"`
+}
+
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// HasTwoFactor reports whether the user has confirmed a TOTP enrollment.
+func (s *Service) HasTwoFactor(userID string) (bool, error) {
+	row := s.db.QueryRow(`SELECT enabled FROM two_factor WHERE user_id=$1`, userID)
+	var enabled bool
+	if err := row.Scan(&enabled); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, common.DataBaseError(err)
+	}
+	return enabled, nil
+}
+
+// EnrollTwoFactor generates a new secret for the user. The secret stays inactive
+// until it is confirmed with a valid code.
+func (s *Service) EnrollTwoFactor(userID string) (TwoFactorEnrollment, error) {
+	u, err := s.FindByCredential(userID)
+	if err != nil {
+		return TwoFactorEnrollment{}, err
+	}
+	enabled, err := s.HasTwoFactor(u.ID)
+	if err != nil {
+		return TwoFactorEnrollment{}, err
+	}
+	if enabled {
+		return TwoFactorEnrollment{}, common.InvalidArgumentError(nil, "two-factor authentication is already enabled")
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return TwoFactorEnrollment{}, common.SystemError(err)
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO two_factor (user_id, secret, enabled) VALUES ($1, $2, false)`, u.ID, secret)
+	if err != nil {
+		return TwoFactorEnrollment{}, common.DataBaseError(err)
+	}
+	return TwoFactorEnrollment{Secret: secret, URI: otpauthURI(secret, u.Login)}, nil
+}
+
+// ConfirmTwoFactor enables a pending enrollment and returns a fresh set of
+// recovery codes. The codes are only shown once.
+func (s *Service) ConfirmTwoFactor(userID, code string) ([]string, error) {
+	secret, enabled, err := s.twoFactorSecret(userID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, common.InvalidArgumentError(nil, "two-factor authentication is already enabled")
+	}
+	if err := s.checkTOTP(userID, secret, code); err != nil {
+		return nil, err
+	}
+	if _, err := s.db.Exec(`UPDATE two_factor SET enabled=true WHERE user_id=$1`, userID); err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	return s.replaceRecoveryCodes(userID)
+}
+
+// DisableTwoFactor removes the enrollment after checking both the password and
+// a current code.
+func (s *Service) DisableTwoFactor(userID, pwd, code string) error {
+	u, err := s.FindByCredential(userID)
+	if err != nil {
+		return err
+	}
+	if !u.comparePassword(u.Password, pwd) {
+		return common.InvalidArgumentError(nil, "password is incorrect")
+	}
+	secret, enabled, err := s.twoFactorSecret(userID)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return common.InvalidArgumentError(nil, "two-factor authentication is not enabled")
+	}
+	if err := s.checkTOTP(userID, secret, code); err != nil {
+		return err
+	}
+	if u.Role.IsPrivileged() {
+		required, err := s.TwoFactorRequired(u.Role)
+		if err != nil {
+			return err
+		}
+		if required {
+			return ErrTwoFactorRequired
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	if _, err := tx.Exec(`DELETE FROM two_factor WHERE user_id=$1`, userID); err != nil {
+		_ = tx.Rollback()
+		return common.DataBaseError(err)
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id=$1`, userID); err != nil {
+		_ = tx.Rollback()
+		return common.DataBaseError(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return common.DataBaseError(err)
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes invalidates all existing recovery codes.
+func (s *Service) RegenerateRecoveryCodes(userID, code string) ([]string, error) {
+	secret, enabled, err := s.twoFactorSecret(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, common.InvalidArgumentError(nil, "two-factor authentication is not enabled")
+	}
+	if err := s.checkTOTP(userID, secret, code); err != nil {
+		return nil, err
+	}
+	return s.replaceRecoveryCodes(userID)
+}
+
+// VerifyChallenge completes a pending login with either a TOTP code or one of
+// the recovery codes.
+func (s *Service) VerifyChallenge(challenge, code, recoveryCode string, c Client) (LoginResult, error) {
+	row := s.db.QueryRow(`SELECT user_id, attempts, expired_at FROM login_challenges WHERE challenge_key=$1`, challenge)
+	var (
+		userID    string
+		attempts  int
+		expiredAt time.Time
+	)
+	if err := row.Scan(&userID, &attempts, &expiredAt); err != nil {
+		return LoginResult{}, common.InvalidArgumentError(err, "login challenge is invalid or expired")
+	}
+	if time.Now().After(expiredAt) || attempts >= maxChallengeAttempts {
+		s.deleteChallenge(challenge)
+		return LoginResult{}, common.InvalidArgumentError(nil, "login challenge is invalid or expired")
+	}
+	u, err := s.FindByCredential(userID)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	// Failed codes count with the failed passwords, so the lockout of the
+	// account also bounds guessing across challenges.
+	if err := s.checkLoginThrottle(u, c); err != nil {
+		return LoginResult{}, err
+	}
+
+	if recoveryCode != "" {
+		err = s.useRecoveryCode(userID, recoveryCode)
+	} else {
+		var secret string
+		secret, _, err = s.twoFactorSecret(userID)
+		if err == nil {
+			err = s.checkTOTP(userID, secret, code)
+		}
+	}
+	if err != nil {
+		if _, dbErr := s.db.Exec(`UPDATE login_challenges SET attempts=attempts+1 WHERE challenge_key=$1`, challenge); dbErr != nil {
+			common.ErrorLogger.Println(dbErr)
+		}
+		s.recordFailure(u, u.Login, c, "two-factor check failed")
+		return LoginResult{}, err
+	}
+
+	s.deleteChallenge(challenge)
+	s.resetAttempts(accountKey(u, ""))
+	return s.startSession(u)
+}
+
+// TwoFactorRequired reports whether the admins require two-factor
+// authentication for the role.
+func (s *Service) TwoFactorRequired(role Role) (bool, error) {
+	row := s.db.QueryRow(`SELECT required FROM two_factor_policy WHERE role=$1`, role)
+	var required bool
+	if err := row.Scan(&required); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, common.DataBaseError(err)
+	}
+	return required, nil
+}
+
+func (s *Service) SetTwoFactorPolicy(role Role, required bool) error {
+	if !role.IsPrivileged() {
+		return common.InvalidArgumentError(nil, "two-factor policy can only be set for privileged roles")
+	}
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO two_factor_policy (role, required) VALUES ($1, $2)`, role, required)
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	return nil
+}
+
+// CheckTwoFactorPolicy returns ErrTwoFactorRequired if the user's role requires
+// two-factor authentication and the user has not enabled it.
+func (s *Service) CheckTwoFactorPolicy(userID string, role Role) error {
+	if !role.IsPrivileged() {
+		return nil
+	}
+	required, err := s.TwoFactorRequired(role)
+	if err != nil || !required {
+		return err
+	}
+	enabled, err := s.HasTwoFactor(userID)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return ErrTwoFactorRequired
+	}
+	return nil
+}
+
+func (s *Service) twoFactorSecret(userID string) (string, bool, error) {
+	row := s.db.QueryRow(`SELECT secret, enabled FROM two_factor WHERE user_id=$1`, userID)
+	var (
+		secret  string
+		enabled bool
+	)
+	if err := row.Scan(&secret, &enabled); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", false, common.InvalidArgumentError(nil, "two-factor authentication is not set up")
+		}
+		return "", false, common.DataBaseError(err)
+	}
+	return secret, enabled, nil
+}
+
+// checkTOTP validates the code and remembers the used time step, so the same
+// code cannot be accepted twice.
+func (s *Service) checkTOTP(userID, secret, code string) error {
+	step, ok := validateTOTP(secret, code, time.Now())
+	if !ok {
+		return errInvalidCode
+	}
+	res, err := s.db.Exec(`UPDATE two_factor SET last_used_step=$1 WHERE user_id=$2 AND last_used_step < $1`, step, userID)
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errInvalidCode
+	}
+	return nil
+}
+
+func (s *Service) replaceRecoveryCodes(userID string) ([]string, error) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, common.SystemError(err)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id=$1`, userID); err != nil {
+		_ = tx.Rollback()
+		return nil, common.DataBaseError(err)
+	}
+	for _, c := range codes {
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hashRecoveryCode(c)); err != nil {
+			_ = tx.Rollback()
+			return nil, common.DataBaseError(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, common.DataBaseError(err)
+	}
+	return codes, nil
+}
+
+func (s *Service) useRecoveryCode(userID, code string) error {
+	res, err := s.db.Exec(`UPDATE recovery_codes SET used_at=$1 WHERE user_id=$2 AND code_hash=$3 AND used_at IS NULL`,
+		time.Now(), userID, hashRecoveryCode(code))
+	if err != nil {
+		return common.DataBaseError(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return common.InvalidArgumentError(nil, "recovery code is invalid")
+	}
+	return nil
+}
+
+func (s *Service) createChallenge(userID string) (string, error) {
+	key := generateCookieCode()
+	_, err := s.db.Exec(`INSERT INTO login_challenges (challenge_key, user_id, expired_at) VALUES ($1, $2, $3)`,
+		key, userID, time.Now().Add(challengeTTL))
+	if err != nil {
+		return "", common.DataBaseError(err)
+	}
+	return key, nil
+}
+
+func (s *Service) deleteChallenge(key string) {
+	if _, err := s.db.Exec(`DELETE FROM login_challenges WHERE challenge_key=$1`, key); err != nil {
+		common.ErrorLogger.Println(err)
+	}
+}
@@ -2,20 +2,23 @@ package user
 
 import (
 	uuid "github.com/satori/go.uuid"
-	"golang.org/x/crypto/bcrypt"
+	"time"
 )
 
 type User struct {
-	ID         string `json:"id"`
-	Email      string `json:"email"`
-	Login      string `json:"login"`
-	Password   string `json:"password,omitempty"`
-	RepeatPWD  string `json:"repeat_pwd,omitempty"`
-	Age        uint   `json:"age"`
-	FirstName  string `json:"first_name"`
-	LastName   string `json:"last_name"`
-	Gender     Gender `json:"gender"`
-	GenderText string `json:"gender_text"`
+	ID         string     `json:"id"`
+	Email      string     `json:"email"`
+	Login      string     `json:"login"`
+	Password   string     `json:"password,omitempty"`
+	RepeatPWD  string     `json:"repeat_pwd,omitempty"`
+	Age        uint       `json:"age"`
+	FirstName  string     `json:"first_name"`
+	LastName   string     `json:"last_name"`
+	Gender     Gender     `json:"gender"`
+	GenderText string     `json:"gender_text"`
+	Role       Role       `json:"role"`
+	CreatedAt  time.Time  `json:"created_at"`
+	DeletionAt *time.Time `json:"deletion_at,omitempty"`
 }
 
 type Gender uint8
@@ -39,18 +42,29 @@ const (
 	Female
 )
 
-func (u *User) generateID() {
-	u.ID = uuid.NewV4().String()
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// IsPrivileged reports whether the role grants moderation or administration rights.
+func (r Role) IsPrivileged() bool {
+	return r == RoleModerator || r == RoleAdmin
+}
+
+func (r Role) IsValid() bool {
+	return r == RoleUser || r.IsPrivileged()
 }
 
-func (u *User) hashPassword() {
-	hash, _ := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
-	u.Password = string(hash)
+func (u *User) generateID() {
+	u.ID = uuid.NewV4().String()
 }
 
 func (u *User) comparePassword(hash, pw string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pw))
-	return err == nil
+	return verifyPassword(hash, pw)
 }
 
 func (u *User) cleanUp() {
@@ -6,14 +6,14 @@ import (
 	"regexp"
 )
 
-func validateUser(u User) error {
+func validateUser(u User, policy PasswordPolicy) error {
 	if err := validateLogin(u.Login); err != nil {
 		return err
 	}
 	if err := validateEmail(u.Email); err != nil {
 		return err
 	}
-	if err := validatePwd(u.Password, u.RepeatPWD); err != nil {
+	if err := policy.validate(u.Password, u.RepeatPWD, u.Login, u.Email); err != nil {
 		return err
 	}
 	if err := validateName(u.FirstName, u.LastName); err != nil {
@@ -26,7 +26,6 @@ func validateUser(u User) error {
 }
 
 var (
-	minLenPwd = 8
 	isCorrect = regexp.MustCompile(`[0-9a-zA-Z]{3,255}$`).MatchString
 )
 
@@ -48,19 +47,6 @@ func validateEmail(email string) error {
 	return nil
 }
 
-func validatePwd(pwd, repeatPWD string) error {
-	if pwd == "" {
-		return common.InvalidArgumentError(nil, "password cannot be empty")
-	}
-	if len(pwd) < minLenPwd {
-		return common.InvalidArgumentError(nil, "password is too short")
-	}
-	if pwd != repeatPWD {
-		return common.InvalidArgumentError(nil, "passwords do not match")
-	}
-	return nil
-}
-
 func validateName(first, last string) error {
 	if first == "" {
 		return common.InvalidArgumentError(nil, "first name is required")
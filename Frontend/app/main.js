@@ -15,8 +15,12 @@ export const WS = () => {
         ws.onopen = () => {
             console.log("Successfully connected");
         }
-        ws.onclose = () => {
+        ws.onclose = event => {
             console.log("connection closed");
+            // the server restarts the connection after a login change
+            if (event.code === 1012) {
+                window.location.reload();
+            }
         }
         ws.onerror = error => {
             console.log("error occurred", error);